@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import "time"
+
+//AccessEntry is the entry of the access log of a request relayed by HandleServer,
+//which is passed to Server.AccessLog.
+type AccessEntry struct {
+	//Name is the name of the relay client to which the request is relayed.
+	Name string
+	//Method is the method of the request.
+	Method string
+	//Path is the path of the URL of the request.
+	Path string
+	//RemoteAddr is the address of the client which sent the request.
+	RemoteAddr string
+	//ID is the ID of the relayed request, which is the last one if retried, or ""
+	//if it is not relayed.
+	ID string
+	//Status is the status code of the response, or 0 if nothing is written, e.g.
+	//the request is canceled or the response is denied.
+	Status int
+	//Bytes is # of bytes of the response body written to the client. It doesn't
+	//include bytes of tunnels.
+	Bytes int64
+	//Start is the time when HandleServer started.
+	Start time.Time
+	//Duration is the time taken by HandleServer.
+	Duration time.Duration
+	//Err is the error of relaying, e.g. ErrNoRelay, or nil if it is relayed.
+	Err error
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"container/list"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//cacheEntry is a cached response of a relay client.
+type cacheEntry struct {
+	key string
+	//base is the key without Vary headers, i.e. name, method and URL.
+	base    string
+	res     *ResponseWriter
+	stored  time.Time
+	expires time.Time
+	size    int64
+}
+
+//responseCache is an in-memory LRU cache of responses keyed by names, methods,
+//URLs and Vary headers of requests.
+type responseCache struct {
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	//vary is the names of Vary headers by base keys.
+	vary map[string][]string
+	//refs is # of entries by base keys.
+	refs map[string]int
+	size int64
+	//now returns the current time if not nil, for tests.
+	now func() time.Time
+}
+
+//clock returns the current time.
+func (c *responseCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+//cacheControl parses Cache-Control headers of h into directives and values.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			kv := strings.SplitN(d, "=", 2)
+			v := ""
+			if len(kv) == 2 {
+				v = strings.Trim(kv[1], `"`)
+			}
+			cc[strings.ToLower(kv[0])] = v
+		}
+	}
+	return cc
+}
+
+//cacheBase returns the key of r to name without Vary headers.
+func cacheBase(name string, r *http.Request) string {
+	return name + " " + r.Method + " " + r.URL.RequestURI()
+}
+
+//cacheKey returns the key of r with the values of vary headers.
+func cacheKey(base string, vary []string, r *http.Request) string {
+	key := base
+	for _, k := range vary {
+		key += "\x00" + strings.Join(r.Header[k], ",")
+	}
+	return key
+}
+
+//cacheable returns true if responses of r can be served from the cache.
+func cacheable(r *http.Request) bool {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, ok := cacheControl(r.Header)["no-store"]
+	return !ok
+}
+
+//revalidate returns true if r requires the response from the relay client.
+func revalidate(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	_, nocache := cc["no-cache"]
+	return nocache || cc["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+}
+
+//varyHeaders returns the canonical names of Vary headers of h, and false if h
+//varies by "*".
+func varyHeaders(h http.Header) ([]string, bool) {
+	var vary []string
+	for _, v := range h["Vary"] {
+		for _, k := range strings.Split(v, ",") {
+			k = strings.TrimSpace(k)
+			switch k {
+			case "":
+				continue
+			case "*":
+				return nil, false
+			}
+			vary = append(vary, textproto.CanonicalMIMEHeaderKey(k))
+		}
+	}
+	return vary, true
+}
+
+//freshness returns when res expires at now, or the zero time if res must not be
+//cached.
+func freshness(res *ResponseWriter, now time.Time) time.Time {
+	switch res.StatusCode {
+	case 0, http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return time.Time{}
+	}
+	if _, ok := res.Head["Set-Cookie"]; ok {
+		return time.Time{}
+	}
+	cc := cacheControl(res.Head)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return time.Time{}
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			sec, err := strconv.Atoi(v)
+			if err != nil || sec <= 0 {
+				return time.Time{}
+			}
+			return now.Add(time.Duration(sec) * time.Second)
+		}
+	}
+	expires, err := http.ParseTime(res.Head.Get("Expires"))
+	if err != nil {
+		return time.Time{}
+	}
+	if date, err := http.ParseTime(res.Head.Get("Date")); err == nil {
+		return now.Add(expires.Sub(date))
+	}
+	return expires
+}
+
+//get returns the fresh response to r to name at now.
+func (c *responseCache) get(name string, r *http.Request, now time.Time) (*ResponseWriter, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	base := cacheBase(name, r)
+	vary, ok := c.vary[base]
+	if !ok {
+		return nil, time.Time{}
+	}
+	el, ok := c.entries[cacheKey(base, vary, r)]
+	if !ok {
+		return nil, time.Time{}
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.remove(el)
+		return nil, time.Time{}
+	}
+	c.lru.MoveToFront(el)
+	return e.res, e.stored
+}
+
+//put caches res to r to name at now if it is cacheable, and evicts the least
+//recently used ones over max bytes.
+func (c *responseCache) put(name string, r *http.Request, res *ResponseWriter, now time.Time, max int64) {
+	if res.stream != nil || len(res.Trailer) > 0 {
+		return
+	}
+	expires := freshness(res, now)
+	if expires.IsZero() || !expires.After(now) {
+		return
+	}
+	vary, ok := varyHeaders(res.Head)
+	if !ok {
+		return
+	}
+	base := cacheBase(name, r)
+	key := cacheKey(base, vary, r)
+	e := &cacheEntry{
+		key:  key,
+		base: base,
+		res: &ResponseWriter{
+			Head:       res.Head.Clone(),
+			Body:       append([]byte(nil), res.Body...),
+			StatusCode: res.StatusCode,
+		},
+		stored:  now,
+		expires: expires,
+		size:    int64(len(key) + len(res.Body)),
+	}
+	if e.size > max {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+		c.vary = make(map[string][]string)
+		c.refs = make(map[string]int)
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.vary[base] = vary
+	c.refs[base]++
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > max {
+		c.remove(c.lru.Back())
+	}
+}
+
+//invalidate removes responses to the URL of r to name.
+func (c *responseCache) invalidate(name string, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lru == nil {
+		return
+	}
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+		if e.base == name+" GET "+r.URL.RequestURI() || e.base == name+" HEAD "+r.URL.RequestURI() {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+//remove removes the entry of el.
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	if c.refs[e.base]--; c.refs[e.base] == 0 {
+		delete(c.refs, e.base)
+		delete(c.vary, e.base)
+	}
+}
+
+//notModified returns true if the conditional request r can be responded with 304
+//for res.
+func notModified(r *http.Request, res *ResponseWriter) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(res.Head.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(res.Head.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+//serveCache writes the fresh cached response to r to name, or 304 if r is
+//conditional and the response is not modified, and returns true if written.
+func (s *Server) serveCache(name string, w http.ResponseWriter, r *http.Request, policy func(http.Header)) bool {
+	if s.CacheBytes <= 0 || !cacheable(r) || revalidate(r) {
+		return false
+	}
+	now := s.cache.clock()
+	cached, stored := s.cache.get(name, r, now)
+	if cached == nil {
+		return false
+	}
+	s.debug().Println("serving cached response", name, r.Method, redactURL(r.URL))
+	res := &ResponseWriter{
+		Head:       cached.Head.Clone(),
+		Body:       cached.Body,
+		StatusCode: cached.StatusCode,
+	}
+	res.Head.Set("Age", strconv.Itoa(int(now.Sub(stored)/time.Second)))
+	if notModified(r, res) {
+		h := make(http.Header)
+		for _, k := range []string{"Age", "Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary"} {
+			if vs, ok := res.Head[k]; ok {
+				h[k] = vs
+			}
+		}
+		res = &ResponseWriter{
+			Head:       h,
+			StatusCode: http.StatusNotModified,
+		}
+	}
+	if err := res.copyTo(w, policy, r.Method == "HEAD"); err != nil {
+		s.logger().Println(err)
+	}
+	return true
+}
+
+//storeCache caches res to r to name if it is cacheable, or invalidates cached
+//responses to the URL if r is unsafe and succeeded.
+func (s *Server) storeCache(name string, r *http.Request, res *ResponseWriter) {
+	if s.CacheBytes <= 0 {
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		if cacheable(r) {
+			s.cache.put(name, r, res, s.cache.clock(), s.CacheBytes)
+		}
+	default:
+		if res.StatusCode < 400 {
+			s.cache.invalidate(name, r)
+		}
+	}
+}
@@ -0,0 +1,667 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+//ErrNotConnected is returned by Serve if Client is not connected.
+var ErrNotConnected = errors.New("not connected")
+
+//Client is a relay client which connects to a relay server with websocket and
+//serves requests relayed from it.
+type Client struct {
+	//Deadlines are timeouts of the connection to the relay server.
+	Deadlines Deadlines
+	//MaxBodyBytes is the max size of response bodies. Handlers get an error when
+	//writing more, and the response is replaced with 502.
+	//No limit if zero, which is the default.
+	MaxBodyBytes int64
+	//Compress offers gzip compression of frames to the relay server.
+	//Frames are not compressed if the server doesn't accept it.
+	Compress bool
+	//Codec is the codec of frames, which must be the same as the one of the relay
+	//server. JSON is used if nil.
+	Codec Codec
+	//TLSConfig is used when connecting to wss:// URLs, e.g. for trusting a private
+	//CA or presenting client certificates. The default config is used if nil.
+	TLSConfig *tls.Config
+	//Header is added to the websocket request, e.g. for authentication with
+	//"Authorization: Bearer <token>".
+	Header http.Header
+	//Name is the name which c requests the relay server to register it as, which
+	//the relay server may accept or rewrite. The name assigned by the relay server
+	//is RegisteredName. The name is not requested if empty.
+	Name string
+	//InstanceID is the stable identity of c advertised to the relay server, so that
+	//requests selected by Server.Instance are routed to c among the relay clients
+	//with the same name.
+	InstanceID string
+	//Backoff is the policy of waiting before reconnecting in ServeReconnect.
+	Backoff Backoff
+	//OnConnect is called when Dial connects to the relay server if not nil.
+	OnConnect func()
+	//OnDisconnect is called with the error when the connection served by Serve is
+	//closed if not nil. The error is *CloseError if the connection is closed or
+	//broken, or *ProtocolError if a malformed frame is received.
+	OnDisconnect func(err error)
+	//Logger is the destination of logs. The standard logger of package log is used
+	//if nil.
+	Logger Logger
+	//DebugLogger is the destination of verbose logs of each step of relaying, e.g.
+	//sending requests and pings. Logger is used if nil, and NopLogger silences them.
+	DebugLogger Logger
+	//RedactHeaders are the headers whose values are redacted in logs of requests,
+	//while they are relayed as is. DefaultRedactHeaders is used if nil, and nothing
+	//is redacted if empty.
+	RedactHeaders []string
+	//ModifyResponse modifies responses of serveHTTP before they are sent to the
+	//relay server if not nil, e.g. for stripping internal headers. Requests are
+	//modified by director of Serve, then passed to serveHTTP, and then their
+	//responses are modified by ModifyResponse. For flushed responses, it is called
+	//before the first flush with the body written so far.
+	ModifyResponse func(w *ResponseWriter)
+	//Authorize is called with requests modified by director before serveHTTP if not
+	//nil. Requests are responded with status instead of serveHTTP if allow is false,
+	//or with 403 if status is zero.
+	Authorize func(r *http.Request) (allow bool, status int)
+	//MinProtocolVersion is the lowest ProtocolVersion of the relay server which is
+	//allowed. Serve returns ErrIncompatibleVersion if the relay server acknowledges
+	//with a lower one. Older relay servers which don't acknowledge Serve are not
+	//checked. All are allowed if zero.
+	MinProtocolVersion int
+
+	ws *conn
+	//registered is the name acknowledged by the relay server for ws.
+	registered string
+	//version is the protocol version negotiated with the relay server for ws.
+	version int
+	mutex   sync.Mutex
+}
+
+var defaultClient = &Client{}
+
+func notifyClose(logger Logger, err error, closed chan struct{}) {
+	logDisconnect(logger, err)
+	if closed != nil {
+		closed <- struct{}{}
+	}
+}
+
+//logger returns the logger of c.
+func (c *Client) logger() Logger {
+	return orStd(c.Logger)
+}
+
+//debug returns the logger of verbose logs of c.
+func (c *Client) debug() Logger {
+	if c.DebugLogger == nil {
+		return c.logger()
+	}
+	return c.DebugLogger
+}
+
+//current returns the current websocket connection.
+func (c *Client) current() *conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ws
+}
+
+//RegisteredName returns the name which the relay server registers c as. It is
+//empty until the relay server acknowledges Serve of the current connection, or
+//with older relay servers.
+func (c *Client) RegisteredName() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.registered
+}
+
+//ProtocolVersion returns the protocol version negotiated with the relay server
+//for the current connection. It is 0 until the relay server acknowledges Serve,
+//or with older relay servers which don't.
+func (c *Client) ProtocolVersion() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.version
+}
+
+//features returns the features supported by c.
+func (c *Client) features() []string {
+	f := []string{featureBatch, featureStream, featureTunnel}
+	if c.Compress {
+		f = append([]string{featureGzip}, f...)
+	}
+	return f
+}
+
+//drop closes ws and forgets it if it is the current connection.
+func (c *Client) drop(ws *conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ws != ws {
+		return
+	}
+	if err := ws.Close(); err != nil {
+		c.logger().Println(err)
+	}
+	c.ws = nil
+	c.registered = ""
+	c.version = 0
+}
+
+//readClient serves requests from ws in new goroutines until an error occurs while
+//reading ws, and returns the error.
+//Chunks of streamed bodies are buffered to the bodies of their requests.
+//Contexts of requests are canceled when they are abandoned by the relay server or
+//the connection is closed.
+func (c *Client) readClient(ws *conn, serveHTTP http.HandlerFunc, director func(*http.Request)) error {
+	streams := make(map[uint64]*bodyStream)
+	var cmutex sync.Mutex
+	cancels := make(map[uint64]context.CancelFunc)
+	defer func() {
+		for _, b := range streams {
+			b.abort(ErrNotConnected)
+		}
+		cmutex.Lock()
+		for _, cancel := range cancels {
+			cancel()
+		}
+		cmutex.Unlock()
+	}()
+	for {
+		var r request
+		if err := ws.receive(&r); err != nil {
+			return err
+		}
+		if r.Refused != "" {
+			return &RefusedError{Reason: r.Refused}
+		}
+		if r.Ready {
+			c.debug().Println("ready is acknowledged, registered as", r.Name)
+			v, common, err := negotiate(r.Version, r.Features, c.MinProtocolVersion, c.features())
+			if err != nil {
+				return err
+			}
+			c.logger().Println("relay server speaks protocol version", v, "with features", common)
+			ws.setFeatures(common)
+			c.mutex.Lock()
+			if c.ws == ws {
+				c.registered = r.Name
+				c.version = v
+			}
+			c.mutex.Unlock()
+			continue
+		}
+		if r.Cancel {
+			c.logger().Println("request is abandoned", r.ID)
+			if b, exist := streams[r.ID]; exist {
+				b.abort(context.Canceled)
+				delete(streams, r.ID)
+			}
+			cmutex.Lock()
+			if cancel, exist := cancels[r.ID]; exist {
+				cancel()
+			}
+			cmutex.Unlock()
+			continue
+		}
+		if r.IsChunk {
+			b, exist := streams[r.ID]
+			if !exist {
+				continue
+			}
+			if err := b.write(r.Seq, r.Body, r.EOF, r.Abort); err != nil || r.EOF {
+				delete(streams, r.ID)
+			}
+			continue
+		}
+		c.debug().Println("received req from websocket", r.redacted(c.RedactHeaders))
+		if r.IsPing {
+			c.debug().Println("received ping")
+			if err := sendPing(ws); err != nil {
+				return err
+			}
+			continue
+		}
+		re, err := r.toRequest()
+		if err != nil {
+			c.logger().Println(err)
+			w := ResponseWriter{
+				ID:         r.ID,
+				Head:       http.Header{RelayErrorHeader: {"bad_request"}},
+				StatusCode: http.StatusBadRequest,
+				Body:       []byte(err.Error()),
+			}
+			if err := ws.send(&w); err != nil {
+				return err
+			}
+			continue
+		}
+		if director != nil {
+			director(re)
+		}
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if r.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(re.Context(), r.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(re.Context())
+		}
+		re = re.WithContext(ctx)
+		cmutex.Lock()
+		cancels[r.ID] = cancel
+		cmutex.Unlock()
+		//requests are served concurrently, so that handlers which stream their
+		//responses don't block reading.
+		var b *bodyStream
+		if r.Streamed {
+			b = newBodyStream()
+			re.Body = b
+			re.GetBody = nil
+			streams[r.ID] = b
+		}
+		var tunnel *bodyStream
+		if r.Tunnel {
+			tunnel = b
+		}
+		go func(id uint64) {
+			defer func() {
+				cmutex.Lock()
+				delete(cancels, id)
+				cmutex.Unlock()
+				cancel()
+			}()
+			if err := c.serve(ws, serveHTTP, re, id, tunnel); err != nil {
+				c.logger().Println(err)
+			}
+			//tunnels are closed by serve or their hijacked connections.
+			if b == nil || tunnel != nil {
+				return
+			}
+			if err := b.Close(); err != nil {
+				c.logger().Println(err)
+			}
+		}(r.ID)
+	}
+}
+
+//serve passes re to serveHTTP and sends its response with id to ws.
+func (c *Client) serve(ws *conn, serveHTTP http.HandlerFunc, re *http.Request, id uint64, tunnel *bodyStream) error {
+	w := ResponseWriter{
+		ID:     id,
+		Body:   getBuffer(),
+		max:    c.MaxBodyBytes,
+		ws:     ws,
+		tunnel: tunnel,
+		modify: c.ModifyResponse,
+	}
+	re = re.WithContext(context.WithValue(re.Context(), writerKey{}, &w))
+	if c.Authorize != nil {
+		if allow, status := c.Authorize(re); !allow {
+			c.logger().Println("request is not authorized", re.Method, redactURL(re.URL))
+			serveHTTP = deny(status)
+		}
+	}
+	panicked := c.call(serveHTTP, &w, re)
+	if w.hijacked {
+		//the last frame is sent when the hijacked connection is closed.
+		return nil
+	}
+	if tunnel != nil {
+		defer func() {
+			if err := tunnel.Close(); err != nil {
+				c.logger().Println(err)
+			}
+		}()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.moveTrailer()
+	switch {
+	case panicked && w.seq > 0:
+		w.Body = w.Body[:0]
+		w.Abort = "handler panicked"
+	case panicked:
+		w = ResponseWriter{
+			ID:         id,
+			StatusCode: http.StatusInternalServerError,
+			Body:       []byte(http.StatusText(http.StatusInternalServerError)),
+			ws:         ws,
+			modify:     c.ModifyResponse,
+		}
+	case w.tooLarge && w.seq > 0:
+		c.logger().Println("response body too large", redactURL(re.URL))
+		w.Body = w.Body[:0]
+		w.Abort = ErrBodyTooLarge.Error()
+	case w.tooLarge:
+		c.logger().Println("response body too large", redactURL(re.URL))
+		w = ResponseWriter{
+			ID:         id,
+			StatusCode: http.StatusBadGateway,
+			Body:       []byte("response body too large"),
+			ws:         ws,
+			modify:     c.ModifyResponse,
+			relayError: "response_too_large",
+		}
+	}
+	w.More = false
+	if err := w.sendFrame(); err != nil {
+		return err
+	}
+	putBuffer(w.Body)
+	c.debug().Println("sent resp to websocket", re.Method, redactURL(re.URL))
+	return nil
+}
+
+//writerKey is the context key of the ResponseWriter of relayed requests.
+type writerKey struct{}
+
+//relayError writes the error response with code and msg to w with RelayErrorHeader
+//of kind, which is kept unlike the ones set by handlers if r is relayed.
+func relayError(w http.ResponseWriter, r *http.Request, kind string, code int, msg string) {
+	if rw, ok := r.Context().Value(writerKey{}).(*ResponseWriter); ok {
+		rw.relayError = kind
+	}
+	w.Header().Set(RelayErrorHeader, kind)
+	http.Error(w, msg, code)
+}
+
+//call calls serveHTTP and recovers its panic, which is logged with the stack like
+//net/http unless it is http.ErrAbortHandler. It returns true if serveHTTP panics,
+//whose response is replaced with 500, or aborted if it is already flushed.
+func (c *Client) call(serveHTTP http.HandlerFunc, w *ResponseWriter, re *http.Request) (panicked bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		panicked = true
+		if p != http.ErrAbortHandler {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			c.logger().Println("panic serving", redactURL(re.URL), p, string(buf))
+		}
+	}()
+	serveHTTP(w, re)
+	return false
+}
+
+//deny returns the handler which responds with status, or 403 if status is zero.
+func deny(status int) http.HandlerFunc {
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+//Dial connects to relayURL with websocket. A connection which was already
+//opened by c is closed.
+func (c *Client) Dial(relayURL, origin string) error {
+	return c.DialContext(context.Background(), relayURL, origin)
+}
+
+//DialContext is Dial which stops connecting when ctx is done, and returns the
+//error of ctx then.
+func (c *Client) DialContext(ctx context.Context, relayURL, origin string) error {
+	if err := c.Close(); err != nil {
+		c.logger().Println(err)
+	}
+	config, err := websocket.NewConfig(relayURL, origin)
+	if err != nil {
+		c.logger().Println(err)
+		return err
+	}
+	config.TlsConfig = c.TLSConfig
+	for k, v := range c.Header {
+		config.Header[k] = v
+	}
+	q := config.Location.Query()
+	if c.Compress {
+		q.Set(compressQuery, "gzip")
+	}
+	if c.Codec != nil {
+		q.Set(codecQuery, c.Codec.Name())
+	}
+	if c.InstanceID != "" {
+		q.Set(instanceQuery, c.InstanceID)
+	}
+	if c.Name != "" {
+		q.Set(nameQuery, c.Name)
+	}
+	q.Set(batchQuery, "1")
+	config.Location.RawQuery = q.Encode()
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		c.logger().Println(err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	c.mutex.Lock()
+	c.registered = ""
+	c.version = 0
+	c.ws = &conn{
+		Conn:      ws,
+		deadlines: c.Deadlines,
+		logger:    c.logger(),
+		debug:     c.debug(),
+		codec:     c.Codec,
+	}
+	c.mutex.Unlock()
+	if c.OnConnect != nil {
+		c.OnConnect()
+	}
+	return nil
+}
+
+//ServeHandler is Serve with http.Handler, e.g. *http.ServeMux or a router with
+//middlewares.
+func (c *Client) ServeHandler(h http.Handler, closed chan struct{}, director func(*http.Request)) error {
+	return c.Serve(h.ServeHTTP, closed, director)
+}
+
+//Serve reads requests from the websocket connected by Dial and passes them to
+//serveHTTP, and writes its response to websocket.
+//It blocks until the connection is closed, and returns the error which closed it.
+func (c *Client) Serve(serveHTTP http.HandlerFunc, closed chan struct{}, director func(*http.Request)) error {
+	ws := c.current()
+	if ws == nil {
+		return ErrNotConnected
+	}
+	//the relay server is told that c is ready to serve.
+	if err := ws.send(&request{Ready: true, Version: ProtocolVersion, Features: c.features()}); err != nil {
+		c.logger().Println(err)
+	}
+	err := closeError(c.readClient(ws, serveHTTP, director))
+	c.drop(ws)
+	if c.OnDisconnect != nil {
+		c.OnDisconnect(err)
+	}
+	notifyClose(c.logger(), err, closed)
+	return err
+}
+
+//Backoff is the policy of waiting before reconnecting. The wait starts from Min and
+//is doubled up to Max every time reconnecting fails. Actual waits are randomized
+//between the half and the whole of it.
+type Backoff struct {
+	//Min is the first wait. It is 1 second if zero.
+	Min time.Duration
+	//Max is the max wait. It is 1 minute if zero.
+	Max time.Duration
+}
+
+//next returns the wait after d.
+func (b Backoff) next(d time.Duration) time.Duration {
+	min, max := b.Min, b.Max
+	if min == 0 {
+		min = time.Second
+	}
+	if max == 0 {
+		max = time.Minute
+	}
+	d *= 2
+	if d < min {
+		d = min
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+//jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+//ServeReconnect connects to relayURL and serves requests like Dial and Serve, and
+//reconnects with Backoff when the connection fails.
+//It blocks until ctx is done, and returns its error.
+func (c *Client) ServeReconnect(ctx context.Context, relayURL, origin string, serveHTTP http.HandlerFunc, director func(*http.Request)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.Close(); err != nil {
+				c.logger().Println(err)
+			}
+		case <-stop:
+		}
+	}()
+	var wait time.Duration
+	for {
+		err := c.DialContext(ctx, relayURL, origin)
+		if err == nil {
+			//ctx may be done before the connection was stored.
+			if ctx.Err() != nil {
+				if err := c.Close(); err != nil {
+					c.logger().Println(err)
+				}
+				return ctx.Err()
+			}
+			wait = 0
+			err = c.Serve(serveHTTP, nil, director)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		wait = c.Backoff.next(wait)
+		c.logger().Println(err, "reconnecting after", wait)
+		select {
+		case <-time.After(jitter(wait)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Close closes the websocket connection.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ws == nil {
+		return nil
+	}
+	c.debug().Println("closing openned websocket")
+	err := c.ws.Close()
+	c.ws = nil
+	c.registered = ""
+	c.version = 0
+	return err
+}
+
+//HandleClient connects to relayURL with websocket , reads requests and passes to
+//serveMux, and write its response to websocket.
+//It uses a default client, so a connection opened by the previous call is closed.
+func HandleClient(relayURL, origin string, serveHTTP http.HandlerFunc, closed chan struct{}, director func(*http.Request)) error {
+	return HandleClientContext(context.Background(), relayURL, origin, serveHTTP, closed, director)
+}
+
+//HandleClientContext is HandleClient which stops connecting when ctx is done, and
+//returns the error of ctx then. ctx doesn't affect the connection after it is
+//connected.
+func HandleClientContext(ctx context.Context, relayURL, origin string, serveHTTP http.HandlerFunc, closed chan struct{}, director func(*http.Request)) error {
+	return handleClient(ctx, relayURL, origin, serveHTTP, director, func(error) {
+		if closed != nil {
+			closed <- struct{}{}
+		}
+	})
+}
+
+//HandleClientE is HandleClient which sends the error which closed the connection
+//to errc instead of notifying without the cause, so that supervisors can decide
+//whether to reconnect, e.g. after *CloseError of network errors. Errors while
+//connecting, e.g. *websocket.DialError when the relay server rejects c, are
+//returned without being sent.
+func HandleClientE(relayURL, origin string, serveHTTP http.HandlerFunc, errc chan<- error, director func(*http.Request)) error {
+	return handleClient(context.Background(), relayURL, origin, serveHTTP, director, func(err error) {
+		if errc != nil {
+			errc <- err
+		}
+	})
+}
+
+//handleClient connects the default client to relayURL within ctx and serves with
+//serveHTTP until closed, and then calls notify with the error which closed it.
+func handleClient(ctx context.Context, relayURL, origin string, serveHTTP http.HandlerFunc, director func(*http.Request), notify func(error)) error {
+	if err := defaultClient.DialContext(ctx, relayURL, origin); err != nil {
+		return err
+	}
+	go func() {
+		err := defaultClient.Serve(serveHTTP, nil, director)
+		if err != nil {
+			defaultClient.logger().Println(err)
+		}
+		notify(err)
+	}()
+	return nil
+}
+
+//HandleClientHandler is HandleClient with http.Handler, e.g. *http.ServeMux or a
+//router with middlewares.
+func HandleClientHandler(relayURL, origin string, h http.Handler, closed chan struct{}, director func(*http.Request)) error {
+	return HandleClient(relayURL, origin, h.ServeHTTP, closed, director)
+}
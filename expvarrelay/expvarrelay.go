@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Package expvarrelay publishes counters of a relay server with package expvar,
+//e.g. for /debug/vars. It is separated from package relay because importing
+//expvar registers /debug/vars to http.DefaultServeMux.
+package expvarrelay
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	relay "github.com/shingetsu-gou/http-relay"
+)
+
+//ErrPublished is returned by Publish if the names are already published.
+var ErrPublished = errors.New("expvar names are already published")
+
+//names are the names published with a prefix.
+var names = []string{"requests", "requests_total", "errors", "errors_total", "in_flight", "in_flight_total", "connected"}
+
+//mutex serializes checking and publishing names, because expvar panics if a name
+//is published twice.
+var mutex sync.Mutex
+
+//metrics is relay.Metrics which counts requests and errors as vars of package
+//expvar, and passes metrics to the Metrics of the server if any.
+type metrics struct {
+	relay.Metrics
+	requests      *expvar.Map
+	requestsTotal *expvar.Int
+	errors        *expvar.Map
+	errorsTotal   *expvar.Int
+}
+
+func (m *metrics) ObserveRequest(name string, status int, dur time.Duration) {
+	m.Metrics.ObserveRequest(name, status, dur)
+	m.requests.Add(name, 1)
+	m.requestsTotal.Add(1)
+}
+
+func (m *metrics) IncError(name string, kind string) {
+	m.Metrics.IncError(name, kind)
+	m.errors.Add(kind, 1)
+	m.errorsTotal.Add(1)
+}
+
+//ObserveBytes passes n to the Metrics of the server if it is relay.BytesMetrics.
+func (m *metrics) ObserveBytes(name string, n int64) {
+	if b, ok := m.Metrics.(relay.BytesMetrics); ok {
+		b.ObserveBytes(name, n)
+	}
+}
+
+//Publish publishes counters of s as the following names with prefix:
+//
+//	requests        # of relayed requests by name
+//	requests_total  # of relayed requests
+//	errors          # of failed requests by kind of IncError of Metrics
+//	errors_total    # of failed requests
+//	in_flight       # of in-flight requests by name
+//	in_flight_total # of in-flight requests
+//	connected       # of relay clients
+//
+//Counters are updated by replacing Metrics of s with one which also passes
+//metrics to the previous one if any. It must be called before s starts relaying,
+//and only once per prefix, because expvar can't unpublish names.
+//It returns ErrPublished if any of the names is already published, e.g. by another
+//Server with the same prefix.
+func Publish(s *relay.Server, prefix string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, n := range names {
+		if expvar.Get(prefix+n) != nil {
+			return ErrPublished
+		}
+	}
+	next := s.Metrics
+	if next == nil {
+		next = relay.NopMetrics{}
+	}
+	s.Metrics = &metrics{
+		Metrics:       next,
+		requests:      expvar.NewMap(prefix + "requests"),
+		requestsTotal: expvar.NewInt(prefix + "requests_total"),
+		errors:        expvar.NewMap(prefix + "errors"),
+		errorsTotal:   expvar.NewInt(prefix + "errors_total"),
+	}
+	expvar.Publish(prefix+"in_flight", expvar.Func(func() interface{} {
+		return s.Status().InFlight
+	}))
+	expvar.Publish(prefix+"in_flight_total", expvar.Func(func() interface{} {
+		n := 0
+		for _, i := range s.Status().InFlight {
+			n += i
+		}
+		return n
+	}))
+	expvar.Publish(prefix+"connected", expvar.Func(func() interface{} {
+		return s.Count()
+	}))
+	return nil
+}
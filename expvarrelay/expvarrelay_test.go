@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package expvarrelay
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	relay "github.com/shingetsu-gou/http-relay"
+	"github.com/shingetsu-gou/http-relay/relaytest"
+)
+
+type testMetrics struct {
+	relay.NopMetrics
+	mutex    sync.Mutex
+	requests int
+	errors   int
+}
+
+func (m *testMetrics) ObserveRequest(name string, status int, dur time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests++
+}
+
+func (m *testMetrics) IncError(name string, kind string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.errors++
+}
+
+//uniquePrefix returns a prefix which is unique per run with -count, because
+//expvar names can't be unpublished.
+func uniquePrefix() string {
+	return fmt.Sprintf("relay_test_%d_", time.Now().UnixNano())
+}
+
+func TestPublish(t *testing.T) {
+	s := relay.NewServer()
+	m := &testMetrics{}
+	s.Metrics = m
+	prefix := uniquePrefix()
+	if err := Publish(s, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish(relay.NewServer(), prefix); err != ErrPublished {
+		t.Fatal("names must not collide", err)
+	}
+	r := relaytest.New(s)
+	defer r.Close()
+	stop, err := r.Connect("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for i := 0; i < 2; i++ {
+		s.HandleServer("test", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), nil)
+	}
+	s.HandleServer("unknown", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), nil)
+	w := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for n, v := range map[string]string{
+		"requests":        `{"test": 2, "unknown": 1}`,
+		"requests_total":  "3",
+		"errors":          `{"not_connected": 1}`,
+		"errors_total":    "1",
+		"in_flight":       `{"test":0}`,
+		"in_flight_total": "0",
+		"connected":       "1",
+	} {
+		if got := string(vars[prefix+n]); got != v {
+			t.Fatal(n, "must be", v, "but", got)
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.requests != 3 || m.errors != 1 {
+		t.Fatal("Metrics must be still called", m.requests, m.errors)
+	}
+}
+
+func TestPublishConcurrently(t *testing.T) {
+	prefix := uniquePrefix()
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Publish(relay.NewServer(), prefix)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	published := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			published++
+		case ErrPublished:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if published != 1 {
+		t.Fatal("names must be published once but", published)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+//Forward returns the handler which forwards relayed requests to the upstream at
+//target with transport, or http.DefaultTransport if nil, instead of serving them
+//locally, so that c works as a reverse-proxy agent of the upstream.
+//The URL of requests is rewritten to target, whose path is prepended to the one of
+//requests and whose query is merged, and Host is the one of target. X-Forwarded-*
+//headers set by the relay server are kept as they are. Errors of transport are
+//written as 502 with RelayErrorHeader "bad_gateway", which is stripped from
+//responses of the upstream.
+func (c *Client) Forward(target *url.URL, transport http.RoundTripper) http.Handler {
+	p := httputil.NewSingleHostReverseProxy(target)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		r.Host = ""
+		//ReverseProxy appends the address of the original client to
+		//X-Forwarded-For unless it is unknown.
+		r.RemoteAddr = ""
+	}
+	p.Transport = transport
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		c.logger().Println("forwarding", redactURL(r.URL), err)
+		relayError(w, r, "bad_gateway", http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+	}
+	return p
+}
+
+//ServeForward is Serve with Forward(target, transport).
+func (c *Client) ServeForward(target *url.URL, transport http.RoundTripper, closed chan struct{}, director func(*http.Request)) error {
+	return c.ServeHandler(c.Forward(target, transport), closed, director)
+}
+
+//HandleClientForward is HandleClient which forwards requests to the upstream at
+//target with transport by Forward of the default client.
+func HandleClientForward(relayURL, origin string, target *url.URL, transport http.RoundTripper, closed chan struct{}, director func(*http.Request)) error {
+	return HandleClientHandler(relayURL, origin, defaultClient.Forward(target, transport), closed, director)
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"net/http"
+	"time"
+)
+
+//Metrics receives metrics of a relay server. Methods must be safe for concurrent
+//use.
+//
+//It can be adapted to prometheus/client_golang like:
+//
+//	type promMetrics struct {
+//		latency   *prometheus.HistogramVec //labels: name, status
+//		errors    *prometheus.CounterVec   //labels: name, kind
+//		queue     *prometheus.GaugeVec     //labels: name
+//		connected prometheus.Gauge
+//	}
+//
+//	func (m *promMetrics) ObserveRequest(name string, status int, dur time.Duration) {
+//		m.latency.WithLabelValues(name, strconv.Itoa(status)).Observe(dur.Seconds())
+//	}
+//
+//	func (m *promMetrics) IncError(name, kind string) {
+//		m.errors.WithLabelValues(name, kind).Inc()
+//	}
+//
+//	func (m *promMetrics) SetQueueDepth(name string, depth int) {
+//		m.queue.WithLabelValues(name).Set(float64(depth))
+//	}
+//
+//	func (m *promMetrics) SetConnected(count int) {
+//		m.connected.Set(float64(count))
+//	}
+type Metrics interface {
+	//ObserveRequest is called when a request to the relay client registered as
+	//name is finished with status after dur.
+	ObserveRequest(name string, status int, dur time.Duration)
+	//IncError is called when a request to name fails. kind is one of
+	//"not_connected", "timeout", "canceled", "disconnected", "request_too_large",
+	//"bad_request", "response_too_large", "denied", "shutting_down", "queue_full",
+	//"rate_limited", "too_many_in_flight" and "not_supported". "canceled" is used both when the
+	//request is canceled by its client and by CancelRequest.
+	IncError(name string, kind string)
+	//SetQueueDepth is called with # of frames queued to the relay client
+	//registered as name when a request is queued.
+	SetQueueDepth(name string, depth int)
+	//SetConnected is called with # of relay clients when it changes.
+	SetConnected(count int)
+}
+
+//BytesMetrics is Metrics which also receives # of body bytes relayed downstream.
+//It is used if Server.Metrics implements it.
+type BytesMetrics interface {
+	Metrics
+	//ObserveBytes is called when a request to name is finished with # of body
+	//bytes written to http.ResponseWriter, including streamed chunks.
+	ObserveBytes(name string, n int64)
+}
+
+//NopMetrics is Metrics which does nothing.
+type NopMetrics struct{}
+
+//ObserveRequest does nothing.
+func (NopMetrics) ObserveRequest(name string, status int, dur time.Duration) {}
+
+//IncError does nothing.
+func (NopMetrics) IncError(name string, kind string) {}
+
+//SetQueueDepth does nothing.
+func (NopMetrics) SetQueueDepth(name string, depth int) {}
+
+//SetConnected does nothing.
+func (NopMetrics) SetConnected(count int) {}
+
+//ObserveBytes does nothing.
+func (NopMetrics) ObserveBytes(name string, n int64) {}
+
+//statusRecorder records the status code written to http.ResponseWriter and
+//the error of relaying.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	err  error
+	//bytes is # of bytes of the written body.
+	bytes int64
+	//id is the ID of the request relayed last.
+	id string
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+//Flush flushes the underlying http.ResponseWriter if it is http.Flusher.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//status returns the written status code, or 200 if nothing is written.
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"crypto/tls"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+//ServerOption configures Server in NewServer.
+type ServerOption interface {
+	applyServer(s *Server)
+}
+
+//ClientOption configures Client in NewClient.
+type ClientOption interface {
+	applyClient(c *Client)
+}
+
+//Option configures both Server and Client.
+type Option interface {
+	ServerOption
+	ClientOption
+}
+
+type serverOption func(s *Server)
+
+func (o serverOption) applyServer(s *Server) {
+	o(s)
+}
+
+type clientOption func(c *Client)
+
+func (o clientOption) applyClient(c *Client) {
+	o(c)
+}
+
+type option struct {
+	serverOption
+	clientOption
+}
+
+//NewClient returns a new Client configured by opts.
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{}
+	for _, o := range opts {
+		o.applyClient(c)
+	}
+	return c
+}
+
+//WithDeadlines sets Deadlines.
+func WithDeadlines(d Deadlines) Option {
+	return option{
+		func(s *Server) { s.Deadlines = d },
+		func(c *Client) { c.Deadlines = d },
+	}
+}
+
+//WithMaxBodyBytes sets MaxBodyBytes.
+func WithMaxBodyBytes(n int64) Option {
+	return option{
+		func(s *Server) { s.MaxBodyBytes = n },
+		func(c *Client) { c.MaxBodyBytes = n },
+	}
+}
+
+//WithCodec sets Codec.
+func WithCodec(codec Codec) Option {
+	return option{
+		func(s *Server) { s.Codec = codec },
+		func(c *Client) { c.Codec = codec },
+	}
+}
+
+//WithCompress sets Compress.
+func WithCompress(compress bool) Option {
+	return option{
+		func(s *Server) { s.Compress = compress },
+		func(c *Client) { c.Compress = compress },
+	}
+}
+
+//WithLogger sets Logger.
+func WithLogger(l Logger) Option {
+	return option{
+		func(s *Server) { s.Logger = l },
+		func(c *Client) { c.Logger = l },
+	}
+}
+
+//WithPingInterval sets Server.PingInterval.
+func WithPingInterval(d time.Duration) ServerOption {
+	return serverOption(func(s *Server) { s.PingInterval = d })
+}
+
+//WithRequestTimeout sets Server.RequestTimeout.
+func WithRequestTimeout(d time.Duration) ServerOption {
+	return serverOption(func(s *Server) { s.RequestTimeout = d })
+}
+
+//WithAuthenticate sets Server.Authenticate.
+func WithAuthenticate(auth func(ws *websocket.Conn) (string, bool)) ServerOption {
+	return serverOption(func(s *Server) { s.Authenticate = auth })
+}
+
+//WithMetrics sets Server.Metrics.
+func WithMetrics(m Metrics) ServerOption {
+	return serverOption(func(s *Server) { s.Metrics = m })
+}
+
+//WithTracer sets Server.Tracer.
+func WithTracer(t Tracer) ServerOption {
+	return serverOption(func(s *Server) { s.Tracer = t })
+}
+
+//WithTLSConfig sets Client.TLSConfig.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return clientOption(func(c *Client) { c.TLSConfig = config })
+}
+
+//WithBackoff sets Client.Backoff.
+func WithBackoff(b Backoff) ClientOption {
+	return clientOption(func(c *Client) { c.Backoff = b })
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//maxBuckets is # of buckets of rateLimiter over which full ones are removed.
+const maxBuckets = 1024
+
+//bucket is a token bucket of a name.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//rateLimiter limits rates of requests by names with token buckets.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+//allow takes a token from the bucket of name which is filled with rate tokens per
+//second up to burst, and returns false if it is empty.
+func (l *rateLimiter) allow(name string, now time.Time, rate float64, burst int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[name]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now, rate, burst)
+		}
+		b = &bucket{
+			tokens: float64(burst),
+			last:   now,
+		}
+		l.buckets[name] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//sweep removes buckets which are full at now, which are the same as new ones.
+func (l *rateLimiter) sweep(now time.Time, rate float64, burst int) {
+	for n, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, n)
+		}
+	}
+}
+
+//rateBurst returns the burst of rate limiting.
+func (s *Server) rateBurst() int {
+	if s.RateBurst > 0 {
+		return s.RateBurst
+	}
+	return int(math.Max(1, math.Ceil(s.RateLimit)))
+}
+
+//allow returns true if a request to name is allowed by RateLimit.
+func (s *Server) allow(name string) bool {
+	if s.RateLimit <= 0 {
+		return true
+	}
+	return s.limiter.allow(name, time.Now(), s.RateLimit, s.rateBurst())
+}
+
+//retryAfter returns seconds to wait for the next token as Retry-After header.
+func (s *Server) retryAfter() string {
+	return strconv.Itoa(int(math.Ceil(1 / s.RateLimit)))
+}
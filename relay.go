@@ -30,11 +30,17 @@ package relay
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -44,9 +50,11 @@ import (
 )
 
 //Request is for relaying http.request , which doesn't include ones that cannot be converted to JSON.
+//Forms are not relayed but parsed from the URL and the raw body by the relay client.
 type request struct {
+	ID               uint64
 	Method           string
-	URL              *url.URL
+	URL              string
 	Proto            string // "HTTP/1.0"
 	ProtoMajor       int    // 1
 	ProtoMinor       int    // 0
@@ -55,76 +63,361 @@ type request struct {
 	ContentLength    int64
 	TransferEncoding []string
 	Host             string
-	Form             url.Values
 	Trailer          http.Header
 	RemoteAddr       string
 	RequestURI       string
-	Error            error
 	IsPing           bool
 	Close            bool
+	//ErrorMsg is the message of the error which occurred while reading the request.
+	ErrorMsg string
+	//Streamed is true if the body is sent by following chunk frames.
+	Streamed bool
+	//Tunnel is true if the request is CONNECT or an upgrade whose connection is
+	//tunneled with chunks and flushed responses.
+	Tunnel bool
+	//IsChunk is true if this is a chunk of the body of the streamed request with ID.
+	IsChunk bool
+	//Seq is the sequence number of the chunk.
+	Seq int
+	//EOF is true if this is the last chunk.
+	EOF bool
+	//Abort is the reason why the streamed body is aborted, sent with the last chunk.
+	Abort string
+	//Timeout is the time left until the deadline of the original request, which is
+	//set to the context of the relayed request. No deadline if zero.
+	Timeout time.Duration
+	//Cancel is true if the request with ID is abandoned by the relay server, which
+	//cancels the context of the relayed request.
+	Cancel bool
+	//Ready is true if this tells the relay server that the relay client starts
+	//serving, or if this is its acknowledgement.
+	Ready bool
+	//Name is the name with which the relay client is registered, sent with the
+	//acknowledgement of Ready.
+	Name string `json:",omitempty"`
+	//Refused is the reason why the relay server refuses the relay client, sent
+	//before closing the connection.
+	Refused string `json:",omitempty"`
+	//Version is the protocol version of the sender, sent with Ready and its
+	//acknowledgement.
+	Version int `json:",omitempty"`
+	//Features is the features supported by the sender, sent with Ready and its
+	//acknowledgement.
+	Features []string `json:",omitempty"`
+	//URLParts is the fields of the URL which may not survive parsing URL, e.g.
+	//paths starting with "//" or raw queries with "#". URL is parsed if nil, e.g.
+	//with older relay servers.
+	URLParts *urlParts `json:",omitempty"`
+
+	//incompressible is true if this is a chunk of the body which is not worth
+	//compressing.
+	incompressible bool
+}
+
+//urlParts is the fields of url.URL, which round-trip with codecs.
+type urlParts struct {
+	Scheme      string
+	Opaque      string
+	User        *userInfo
+	Host        string
+	Path        string
+	RawPath     string
+	RawQuery    string
+	Fragment    string
+	RawFragment string
+	ForceQuery  bool
+}
+
+//userInfo is the fields of url.Userinfo.
+type userInfo struct {
+	Username    string
+	Password    string
+	PasswordSet bool
+}
+
+//newURLParts returns the fields of u.
+func newURLParts(u *url.URL) *urlParts {
+	var user *userInfo
+	if u.User != nil {
+		pass, ok := u.User.Password()
+		user = &userInfo{
+			Username:    u.User.Username(),
+			Password:    pass,
+			PasswordSet: ok,
+		}
+	}
+	return &urlParts{
+		Scheme:      u.Scheme,
+		Opaque:      u.Opaque,
+		User:        user,
+		Host:        u.Host,
+		Path:        u.Path,
+		RawPath:     u.RawPath,
+		RawQuery:    u.RawQuery,
+		Fragment:    u.Fragment,
+		RawFragment: u.RawFragment,
+		ForceQuery:  u.ForceQuery,
+	}
 }
 
+//setTo sets the fields to u.
+func (p *urlParts) setTo(u *url.URL) {
+	u.Scheme = p.Scheme
+	u.Opaque = p.Opaque
+	switch {
+	case p.User == nil:
+		u.User = nil
+	case p.User.PasswordSet:
+		u.User = url.UserPassword(p.User.Username, p.User.Password)
+	default:
+		u.User = url.User(p.User.Username)
+	}
+	u.Host = p.Host
+	u.Path = p.Path
+	u.RawPath = p.RawPath
+	u.RawQuery = p.RawQuery
+	u.Fragment = p.Fragment
+	u.RawFragment = p.RawFragment
+	u.ForceQuery = p.ForceQuery
+}
+
+//ErrBodyTooLarge is returned when the size of body exceeds the limit, e.g. by
+//HandleServerE if the request body exceeds MaxBodyBytes.
+var ErrBodyTooLarge = errors.New("body too large")
+
 //fromRequest converts http.Request to request.
-func fromRequest(r *http.Request, err error) *request {
+//It returns ErrBodyTooLarge if the body is larger than max bytes, which is also
+//set to ErrorMsg with other errors. No limit if max is zero.
+func fromRequest(r *http.Request, max int64) (*request, error) {
+	re := newRequest(r, nil)
+	return re, re.readBody(r.Body, max)
+}
+
+//readBody reads body into r which is not streamed anymore, like fromRequest.
+func (r *request) readBody(body io.ReadCloser, max int64) error {
+	r.Streamed = false
+	var err error
+	if max > 0 {
+		r.Body, err = readAll(io.LimitReader(body, max+1), getBuffer())
+		if err == nil && int64(len(r.Body)) > max {
+			err = ErrBodyTooLarge
+		}
+	} else {
+		r.Body, err = readAll(body, getBuffer())
+	}
+	err2 := body.Close()
+	if err == nil {
+		err = err2
+	}
+	r.setError(err)
+	return err
+}
+
+//release returns the body of r to the pool of buffers. r must not be used after
+//it is encoded and sent.
+func (r *request) release() {
+	putBuffer(r.Body)
+	r.Body = nil
+}
+
+//maxPooledBuffer is the max capacity of buffers returned to bufferPool, so that
+//large bodies don't stay in memory.
+const maxPooledBuffer = 1 << 20
+
+//bufferPool is the pool of buffers for bodies of requests and responses.
+var bufferPool sync.Pool
+
+//getBuffer returns an empty buffer from bufferPool.
+func getBuffer() []byte {
+	if b, ok := bufferPool.Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, 512)
+}
+
+//putBuffer returns b to bufferPool.
+func putBuffer(b []byte) {
+	if cap(b) == 0 || cap(b) > maxPooledBuffer {
+		return
+	}
+	b = b[:0]
+	bufferPool.Put(&b)
+}
+
+//readAll reads r until EOF and appends to b like ioutil.ReadAll.
+func readAll(r io.Reader, b []byte) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
+
+//streamRequest converts http.Request to request whose body is sent later by chunks.
+func streamRequest(r *http.Request) *request {
+	re := newRequest(r, nil)
+	re.Streamed = true
+	return re
+}
+
+//newRequest converts http.Request except its body to request.
+//Expect is not relayed, because the relay server reads the body, which makes
+//net/http send 100 Continue, and relay clients receive it without waiting.
+func newRequest(r *http.Request, err error) *request {
+	h := r.Header
+	if _, ok := h["Expect"]; ok {
+		h = h.Clone()
+		h.Del("Expect")
+	}
 	re := &request{
 		Method:           r.Method,
-		URL:              r.URL,
+		URL:              r.URL.String(),
+		URLParts:         newURLParts(r.URL),
 		Proto:            r.Proto,
 		ProtoMajor:       r.ProtoMajor,
 		ProtoMinor:       r.ProtoMinor,
-		Header:           r.Header,
+		Header:           h,
 		ContentLength:    r.ContentLength,
 		TransferEncoding: r.TransferEncoding,
 		Close:            r.Close,
 		Host:             r.Host,
-		Form:             r.Form,
 		Trailer:          r.Trailer,
 		RemoteAddr:       r.RemoteAddr,
 		RequestURI:       r.RequestURI,
-		Error:            err,
 	}
-	re.Body, err = ioutil.ReadAll(r.Body)
-	err2 := r.Body.Close()
+	re.setError(err)
+	return re
+}
+
+//setError sets the message of err to ErrorMsg if err is not nil.
+func (r *request) setError(err error) {
 	if err != nil {
-		re.Error = err
-		return re
+		r.ErrorMsg = err.Error()
 	}
-	if err2 != nil {
-		re.Error = err2
+}
+
+//err returns the error whose message is ErrorMsg, or nil if ErrorMsg is empty.
+func (r *request) err() error {
+	if r.ErrorMsg == "" {
+		return nil
 	}
-	return re
+	return errors.New(r.ErrorMsg)
 }
 
 //toRequst converts request to http.Request
+//URL is kept as received, in origin-form or absolute-form, and Host is the one of
+//the original request, which is the authority of absolute-form URLs or the Host
+//header. So Host wins if they differ, and the authority of URL is used only if Host
+//is empty.
+//Proto, ProtoMajor and ProtoMinor are the ones of the original request, but they
+//are informational: the relayed request is served like HTTP/1.1 without features
+//of HTTP/2 such as http.Pusher.
+//Header and Body are never nil, and Body is http.NoBody if empty, like requests of
+//net/http servers, so that standard middlewares work with it.
 func (r *request) toRequest() (*http.Request, error) {
-	if r.Error != nil {
-		return nil, r.Error
+	if err := r.err(); err != nil {
+		return nil, err
 	}
 	b := bytes.NewReader(r.Body)
-	re, err := http.NewRequest(r.Method, r.URL.String(), b)
+	//the URL is relayed as a string, because url.URL doesn't round-trip with JSON.
+	//It is restored from URLParts if any instead, because the string may be parsed
+	//differently, e.g. paths starting with "//".
+	u := r.URL
+	if r.URLParts != nil {
+		u = ""
+	}
+	re, err := http.NewRequest(r.Method, u, b)
 	if err != nil {
 		return nil, err
 	}
-	re.Proto = r.Proto
-	re.ProtoMajor = r.ProtoMajor
-	re.ProtoMinor = r.ProtoMinor
-	re.Header = r.Header
+	if r.URLParts != nil {
+		r.URLParts.setTo(re.URL)
+		re.Host = re.URL.Host
+	}
+	//NewRequest's HTTP/1.1 is kept if the original one is unknown.
+	if r.Proto != "" {
+		re.Proto = r.Proto
+		re.ProtoMajor = r.ProtoMajor
+		re.ProtoMinor = r.ProtoMinor
+	}
+	//empty headers may be decoded as nil, e.g. by Gob, but middlewares expect
+	//them to be writable like the ones of net/http.
+	if r.Header != nil {
+		re.Header = r.Header
+	}
 	re.ContentLength = r.ContentLength
 	re.TransferEncoding = r.TransferEncoding
+	//chunked requests stay chunked when they are sent to backends.
+	if isChunked(r.TransferEncoding) {
+		re.ContentLength = -1
+		re.Header.Del("Content-Length")
+	}
 	re.Close = r.Close
-	re.Host = r.Host
-	re.Form = r.Form
+	if r.Host != "" {
+		re.Host = r.Host
+	}
 	re.Trailer = r.Trailer
 	re.RemoteAddr = r.RemoteAddr
 	re.RequestURI = r.RequestURI
 	return re, nil
 }
 
+//isChunked returns true if te is the chunked transfer encoding.
+func isChunked(te []string) bool {
+	return len(te) > 0 && strings.EqualFold(te[len(te)-1], "chunked")
+}
+
 //ResponseWriter is simple struct for http.ResponseWriter.
+//It implements http.Flusher in relay clients, and flushed responses are sent by
+//multiple frames with the same ID. Responses of text/event-stream are flushed
+//on every Write.
 type ResponseWriter struct {
+	ID         uint64
 	Head       http.Header
 	Body       []byte
 	StatusCode int
+	//More is true if this is a flushed part of the response and more frames follow.
+	More bool
+	//Seq is the sequence number of the frame of the flushed response.
+	Seq int
+	//Abort is the reason why the flushed response is aborted, sent with the last frame.
+	Abort string
+	//Trailer is the trailers of the response, sent with the last frame.
+	Trailer http.Header
+	//Hijacked is true if the body is raw bytes written to the hijacked connection.
+	Hijacked bool
+
+	max      int64
+	tooLarge bool
+	//written is the size of the body including flushed parts.
+	written int64
+	seq     int
+	err     error
+	//ws is the connection to which the response is flushed.
+	ws *conn
+	//stream is the rest of the flushed response in the relay server.
+	stream *bodyStream
+	//tunnel is the body of the tunneled request, which is read by the hijacked
+	//connection.
+	tunnel   *bodyStream
+	hijacked bool
+	//wroteHeader is true if the status is set by WriteHeader or Write.
+	wroteHeader bool
+	//modify modifies the response before its header is sent.
+	modify func(*ResponseWriter)
+	//relayError is the kind of the error of the relay client written as
+	//RelayErrorHeader, which is stripped from responses of handlers otherwise.
+	relayError string
+	//incompressible is true if the body is not worth compressing.
+	incompressible bool
 }
 
 // Header returns the header map that will be sent by
@@ -145,250 +438,968 @@ func (r *ResponseWriter) Header() http.Header {
 // before writing the data.  If the Header does not contain a
 // Content-Type line, Write adds a Content-Type set to the result of passing
 // the initial 512 bytes of written data to DetectContentType.
+//
+//Write returns ErrBodyTooLarge if the body exceeds the limit of the relay client.
 func (r *ResponseWriter) Write(d []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.max > 0 && r.written+int64(len(d)) > r.max {
+		n := int(r.max - r.written)
+		r.Body = append(r.Body, d[:n]...)
+		r.written += int64(n)
+		r.tooLarge = true
+		return n, ErrBodyTooLarge
+	}
 	r.Body = append(r.Body, d...)
+	r.written += int64(len(d))
+	if r.isEventStream() {
+		r.Flush()
+		if r.err != nil {
+			return len(d), r.err
+		}
+	}
 	return len(d), nil
 }
 
+//moveTrailer moves the values of trailers, which are declared in "Trailer" header or
+//prefixed with http.TrailerPrefix, from Head to Trailer after the handler finishes.
+func (r *ResponseWriter) moveTrailer() {
+	move := func(from, to string) {
+		if v, ok := r.Head[from]; ok {
+			if r.Trailer == nil {
+				r.Trailer = make(http.Header)
+			}
+			r.Trailer[to] = v
+			delete(r.Head, from)
+		}
+	}
+	for _, vs := range r.Head["Trailer"] {
+		for _, k := range strings.Split(vs, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			move(k, k)
+		}
+	}
+	for k := range r.Head {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			move(k, http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix)))
+		}
+	}
+}
+
+//writeTrailer writes trailer to w after its body.
+func writeTrailer(w http.ResponseWriter, trailer http.Header) {
+	for k, vs := range trailer {
+		for _, v := range vs {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+//isEventStream returns true if the response is Server-Sent Events, whose chunks
+//are flushed every time they are written.
+func (r *ResponseWriter) isEventStream() bool {
+	return r.ws != nil && strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream")
+}
+
+//Flush sends the header and the body written so far to the relay server, which
+//writes and flushes them to the original response.
+//The response is buffered instead if the relay server doesn't support streams.
+func (r *ResponseWriter) Flush() {
+	if r.ws == nil || !r.ws.has(featureStream) || r.err != nil || r.tooLarge {
+		return
+	}
+	r.More = true
+	if r.err = r.sendFrame(); r.err != nil {
+		r.ws.logger.Println(r.err)
+	}
+}
+
+//sendFrame sends the header if it is the first frame and the body written after the
+//previous frame to ws.
+func (r *ResponseWriter) sendFrame() error {
+	if r.seq == 0 && r.Head != nil {
+		delete(r.Head, RelayErrorHeader)
+	}
+	if r.seq == 0 && r.relayError != "" {
+		r.Header().Set(RelayErrorHeader, r.relayError)
+	}
+	if r.seq == 0 && r.modify != nil && !r.Hijacked {
+		r.modify(r)
+	}
+	f := ResponseWriter{
+		ID:       r.ID,
+		Body:     r.Body,
+		More:     r.More,
+		Seq:      r.seq,
+		Abort:    r.Abort,
+		Hijacked: r.Hijacked,
+		//the header is sent only with the first frame.
+		incompressible: !compressible(r.Head),
+	}
+	if !r.More {
+		f.Trailer = r.Trailer
+	}
+	if r.seq == 0 {
+		f.Head = r.Head
+		f.StatusCode = r.StatusCode
+		//the status is 200 only if it is never set, like net/http.
+		if f.StatusCode == 0 {
+			f.StatusCode = http.StatusOK
+		}
+	}
+	r.Body = nil
+	r.seq++
+	if err := r.ws.send(&f); err != nil {
+		return err
+	}
+	//the body is encoded, so its buffer is reused for the next frame.
+	r.Body = f.Body[:0]
+	return nil
+}
+
 // WriteHeader sends an HTTP response header with status code.
 // If WriteHeader is not called explicitly, the first call to Write
 // will trigger an implicit WriteHeader(http.StatusOK).
 // Thus explicit calls to WriteHeader are mainly used to
 // send error codes.
+//
+//Like net/http, only the first call is effective, informational 1xx statuses except
+//101 are ignored because they can't be relayed, and it panics if s is not a valid
+//status code, e.g. 0.
 func (r *ResponseWriter) WriteHeader(s int) {
+	if s < 100 || s > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", s))
+	}
+	if r.wroteHeader {
+		if r.ws != nil {
+			r.ws.logger.Println("superfluous WriteHeader call with", s)
+		}
+		return
+	}
+	if s >= 100 && s < 200 && s != http.StatusSwitchingProtocols {
+		return
+	}
+	r.wroteHeader = true
 	r.StatusCode = s
 }
 
-//copyTo copies r to http.ResponseWriter
-func (r *ResponseWriter) copyTo(w http.ResponseWriter) error {
+//hopHeaders are hop-by-hop headers in RFC 7230, which are not relayed to clients.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//isHopHeader returns true if k is a hop-by-hop header, including ones listed in
+//the Connection header h.
+func isHopHeader(h http.Header, k string) bool {
+	for _, hh := range hopHeaders {
+		if strings.EqualFold(k, hh) {
+			return true
+		}
+	}
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(k, strings.TrimSpace(f)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//copyTo copies r to http.ResponseWriter except hop-by-hop headers.
+//The header is modified by policy before copied if policy is not nil.
+//Content-Length is set to the length of the body if it is not in the header and
+//the response is neither flushed nor has trailers.
+//The body is not written if the status doesn't allow it, e.g. 204 and 304, or if
+//head is true for responses to HEAD, whose Content-Length is still the length of
+//the body written by the handler, if any.
+func (r *ResponseWriter) copyTo(w http.ResponseWriter, policy func(h http.Header), head bool) error {
+	if policy != nil {
+		if r.Head == nil {
+			r.Head = make(http.Header)
+		}
+		policy(r.Head)
+	}
 	for k, vs := range r.Head {
+		if isHopHeader(r.Head, k) {
+			continue
+		}
 		for _, v := range vs {
 			w.Header().Add(k, v)
 		}
 	}
-	if r.StatusCode != 0 {
-		w.WriteHeader(r.StatusCode)
+	if !r.More && len(r.Trailer) == 0 && w.Header().Get("Trailer") == "" &&
+		w.Header().Get("Content-Length") == "" && bodyAllowed(r.StatusCode) && (!head || len(r.Body) > 0) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	status := r.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if !bodyAllowed(status) || head {
+		return nil
 	}
 	if _, err := w.Write(r.Body); err != nil {
 		return err
 	}
+	writeTrailer(w, r.Trailer)
 	return nil
 }
 
-var sockets = make(map[string]*wsRelayServer)
-var count int32
-var mutex sync.RWMutex
-
-type wsRelayServer struct {
-	ws   *websocket.Conn
-	msg  chan interface{}
-	stop chan struct{}
+//bodyStream is a body being streamed by chunks, which is the body of a request
+//from the relay server or of a flushed response from a relay client.
+//Chunks are buffered in memory, so that writing them never blocks on reading the
+//body.
+type bodyStream struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	err    error
+	closed bool
+	seq    int
+	//trailer is the trailers of the flushed response.
+	trailer http.Header
 }
 
-//Count returns # of relay clients.
-func Count() int32 {
-	return atomic.LoadInt32(&count)
+func newBodyStream() *bodyStream {
+	b := &bodyStream{}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
 }
 
-//IsAccepted retruns true if prefix is already accepted.
-func IsAccepted(prefix string) bool {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	for n := range sockets {
-		if strings.HasPrefix(n, prefix) {
-			return true
+//write appends the chunk data with seq to the body, and ends the body with abort
+//if eof. It never blocks.
+func (b *bodyStream) write(seq int, data []byte, eof bool, abort string) error {
+	if seq != b.seq {
+		err := errors.New("out of order chunk")
+		b.abort(err)
+		return err
+	}
+	b.seq++
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	if len(data) > 0 {
+		b.chunks = append(b.chunks, data)
+	}
+	if eof {
+		b.err = io.EOF
+		if abort != "" {
+			b.err = errors.New(abort)
 		}
 	}
-	return false
+	b.cond.Broadcast()
+	return nil
 }
 
-//StartServe starts to relay.
-//It registers ws connection as name and wait for w.stop channel signal.
-func StartServe(name string, ws *websocket.Conn) {
-	w := &wsRelayServer{
-		ws:   ws,
-		msg:  make(chan interface{}),
-		stop: make(chan struct{}),
-	}
-	setDeadlines(ws)
-
-	mutex.Lock()
-	if old := sockets[name]; old != nil {
-		old.stop <- struct{}{}
-	}
-	sockets[name] = w
-	mutex.Unlock()
-	w.writePump()
-
-	<-w.stop
-	log.Println("relay exited")
-	atomic.AddInt32(&count, -1)
-	if err := ws.Close(); err != nil {
-		log.Println(err)
-	}
-	delete(sockets, name)
-}
-
-//StopServe stops relaying associated with name.
-func StopServe(name string) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	if w, exist := sockets[name]; exist {
-		w.stop <- struct{}{}
-	}
-}
-
-func (r *wsRelayServer) writePump() {
-	go func() {
-		for {
-			select {
-			case <-time.Tick(time.Minute):
-				if err := sendPing(r.ws); err != nil {
-					log.Println(err)
-					r.stop <- struct{}{}
-					return
-				}
-				if err := recvPing(r.ws); err != nil {
-					log.Println(err)
-					r.stop <- struct{}{}
-					return
-				}
-			case req := <-r.msg:
-				if err := websocket.JSON.Send(r.ws, req); err != nil {
-					log.Println(err)
-					r.stop <- struct{}{}
-					return
-				}
-			}
-		}
-	}()
+//setTrailer sets the trailers of the flushed response, which are written after
+//the body.
+func (b *bodyStream) setTrailer(trailer http.Header) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trailer = trailer
 }
 
-func recvPing(ws *websocket.Conn) error {
-	var req request
-	if err := websocket.JSON.Receive(ws, &req); err != nil {
-		log.Println(err)
-		return err
+//getTrailer returns the trailers of the flushed response.
+func (b *bodyStream) getTrailer() http.Header {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.trailer
+}
+
+//abort makes reading the body fail with err.
+func (b *bodyStream) abort(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err == nil {
+		b.err = err
 	}
-	if !req.IsPing {
-		err := errors.New("not ping")
-		log.Println(err)
-		return err
+	b.cond.Broadcast()
+}
+
+//Read reads the buffered chunks, waiting for them if there is none.
+func (b *bodyStream) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for len(b.chunks) == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.chunks) == 0 {
+		return 0, b.err
 	}
-	log.Println("pong received")
+	n := copy(p, b.chunks[0])
+	if n == len(b.chunks[0]) {
+		b.chunks = b.chunks[1:]
+	} else {
+		b.chunks[0] = b.chunks[0][n:]
+	}
+	return n, nil
+}
+
+//Close discards the buffered chunks and the ones written later.
+func (b *bodyStream) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.chunks = nil
+	b.cond.Broadcast()
 	return nil
 }
 
-func sendPing(ws *websocket.Conn) error {
-	log.Println("sendig ping")
-	req := request{
+//bodyAllowed returns true if responses with status can have a body.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+//sendNativePing sends a websocket ping frame within the write deadline.
+func (c *conn) sendNativePing() error {
+	c.debug.Println("sending native ping")
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err := c.SetWriteDeadline(time.Now().Add(c.deadlines.write())); err != nil {
+		return err
+	}
+	//codecs write frames with their own types, so PayloadType is used only here.
+	c.PayloadType = websocket.PingFrame
+	defer func() {
+		c.PayloadType = websocket.TextFrame
+	}()
+	_, err := c.Write(nil)
+	return err
+}
+
+func sendPing(ws *conn) error {
+	ws.debug.Println("sendig ping")
+	req := &request{
 		IsPing: true,
 	}
-	return websocket.JSON.Send(ws, req)
+	return ws.send(req)
 }
 
-//HandleServer relays request r to websocket and recieve response and writes it to w.
-func HandleServer(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) {
-	mutex.RLock()
-	wsr := sockets[name]
-	mutex.RUnlock()
-	if wsr == nil {
-		log.Println("not found", name)
-		return
+//Deadlines are timeouts of websocket connection, which are renewed every time a
+//frame is read or written. So they are timeouts of inactivity rather than limits
+//of the lifetime of connections, and long streamed responses survive them.
+//Idle connections are kept alive by pings of the relay server and their pongs,
+//so Read should be longer than Server.PingInterval on both sides.
+type Deadlines struct {
+	//Read is the time to wait for the next frame. The connection is closed if no frame
+	//is received within it.
+	Read time.Duration
+	//Write is the time to wait for writing a frame.
+	Write time.Duration
+}
+
+//DefaultDeadlines is used for zero fields of Deadlines.
+var DefaultDeadlines = Deadlines{
+	Read:  3 * time.Minute,
+	Write: time.Minute,
+}
+
+func (d Deadlines) read() time.Duration {
+	if d.Read == 0 {
+		return DefaultDeadlines.Read
 	}
+	return d.Read
+}
 
-	re := fromRequest(r, nil)
-	wsr.msg <- re
-	log.Println("sent request to websocket", re)
+func (d Deadlines) write() time.Duration {
+	if d.Write == 0 {
+		return DefaultDeadlines.Write
+	}
+	return d.Write
+}
 
-	var res ResponseWriter
-	if err := websocket.JSON.Receive(wsr.ws, &res); err != nil {
-		log.Println(err)
-		wsr.stop <- struct{}{}
-		return
+//instanceQuery is the query parameter of the websocket URL with which clients
+//advertise their instance IDs.
+const instanceQuery = "instance"
+
+//compressThreshold is the min size of frames which are compressed.
+const compressThreshold = 1024
+
+//compressor is a frame which tells whether it is worth compressing.
+type compressor interface {
+	compressible() bool
+}
+
+//worthCompressing returns true if frame v of size bytes should be compressed.
+func worthCompressing(v interface{}, size int) bool {
+	//gzipped pings tell the peer that compression is accepted.
+	if re, ok := v.(*request); ok && re.IsPing {
+		return true
 	}
-	log.Println("recv response from websocket")
-	if doAccept != nil && !doAccept(&res) {
-		log.Println("reponse is denied")
-		return
+	if size < compressThreshold {
+		return false
 	}
-	if err := res.copyTo(w); err != nil {
-		log.Println(err)
-		return
+	if c, ok := v.(compressor); ok {
+		return c.compressible()
 	}
+	return true
 }
 
-func setDeadlines(ws *websocket.Conn) {
-	if err := ws.SetDeadline(time.Now().Add(100 * time.Hour)); err != nil {
-		log.Fatal(err)
+func (r *request) compressible() bool {
+	return !r.incompressible && compressible(r.Header)
+}
+
+func (r *ResponseWriter) compressible() bool {
+	return !r.incompressible && compressible(r.Head)
+}
+
+//compressible returns true if the body with header h is text-ish or unknown data,
+//and is not compressed yet.
+func compressible(h http.Header) bool {
+	if e := h.Get("Content-Encoding"); e != "" && e != "identity" {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return true
 	}
-	if err := ws.SetReadDeadline(time.Now().Add(100 * time.Hour)); err != nil {
-		log.Fatal(err)
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
 	}
-	if err := ws.SetWriteDeadline(time.Now().Add(100 * time.Hour)); err != nil {
-		log.Fatal(err)
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	switch {
+	case strings.HasPrefix(ct, "text/"),
+		strings.HasSuffix(ct, "+json"), strings.HasSuffix(ct, "+xml"):
+		return true
 	}
+	switch ct {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-www-form-urlencoded", "application/wasm":
+		return true
+	}
+	return false
 }
 
-func close(err error, closed chan struct{}) {
-	log.Println(err)
-	if closed != nil {
-		closed <- struct{}{}
+//compressQuery is the query parameter of the websocket URL with which clients offer
+//gzip compression.
+//
+//Payloads are gzipped by the relay instead of the permessage-deflate extension
+//(RFC 7692), because golang.org/x/net/websocket can negotiate no extension: its
+//server never answers Sec-WebSocket-Extensions, its client refuses responses with
+//it, and frames with RSV1 cannot be read or written. Supporting the extension needs
+//another websocket implementation, e.g. github.com/gorilla/websocket, in place of
+//*websocket.Conn in the API, not a shim of this package.
+const compressQuery = "compress"
+
+//flagGzip is set in the flags of binary frames whose payload is gzipped.
+const flagGzip = 1
+
+//flagBatch is set in the flags of binary frames whose payload is a batch of frames.
+const flagBatch = 2
+
+//nameQuery is the query parameter of the websocket URL with which clients request
+//the names to be registered as.
+const nameQuery = "name"
+
+//batchQuery is the query parameter of the websocket URL with which clients tell
+//that they can receive batches.
+const batchQuery = "batch"
+
+//ProtocolVersion is the version of the protocol of relaying, which relay servers
+//and clients exchange with features in the handshake, i.e. Ready frames and their
+//acknowledgements, right after connecting. Peers which don't send it have version
+//1, and the negotiated version is the lower one.
+const ProtocolVersion = 2
+
+//ErrIncompatibleVersion is returned if the protocol version of the peer is lower
+//than MinProtocolVersion of Server or Client.
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+//Features which are exchanged in the handshake.
+const (
+	//featureGzip is compressing frames with gzip.
+	featureGzip = "gzip"
+	//featureBatch is coalescing frames into batches.
+	featureBatch = "batch"
+	//featureStream is streaming request bodies and flushed responses by chunks.
+	featureStream = "stream"
+	//featureTunnel is tunneling CONNECT and upgrade requests.
+	featureTunnel = "tunnel"
+)
+
+//featureNames are the features which are negotiated, whose bits in the features of
+//conn are their indices.
+var featureNames = []string{featureGzip, featureBatch, featureStream, featureTunnel}
+
+//negotiate returns the negotiated version and features with the peer which sent
+//version and features, or ErrIncompatibleVersion if the version of the peer is
+//lower than min.
+func negotiate(version int, features []string, min int, own []string) (int, []string, error) {
+	if version <= 0 {
+		version = 1
+	}
+	if version < min {
+		return 0, nil, fmt.Errorf("%w %d, %d or higher is required", ErrIncompatibleVersion, version, min)
 	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	var common []string
+	for _, f := range own {
+		for _, g := range features {
+			if f == g {
+				common = append(common, f)
+				break
+			}
+		}
+	}
+	return version, common, nil
 }
 
-var clientWS *websocket.Conn
+//errBadFrame is returned when a binary frame has no flags or a broken batch.
+var errBadFrame = errors.New("bad frame")
 
-func readClient(serveHTTP http.HandlerFunc, closed chan struct{}, director func(*http.Request)) {
-	for {
-		var r request
-		if err := websocket.JSON.Receive(clientWS, &r); err != nil {
-			close(err, closed)
-			return
-		}
-		log.Println("received req from websocket", r)
-		if r.IsPing {
-			log.Println("received ping")
-			if err := sendPing(clientWS); err != nil {
-				close(err, closed)
-				return
-			}
-			continue
+//rawFrame is a payload of a websocket frame.
+type rawFrame struct {
+	data   []byte
+	binary bool
+}
+
+//rawCodec sends and receives frames as they are.
+var rawCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(rawFrame)
+		if f.binary {
+			return f.data, websocket.BinaryFrame, nil
 		}
-		re, err := r.toRequest()
-		if err != nil {
-			log.Println(err)
+		return f.data, websocket.TextFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*rawFrame)
+		f.data = data
+		f.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+//Logger is the destination of logs of Server and Client. *log.Logger implements it.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+//stdLogger writes logs to the standard logger of package log.
+type stdLogger struct{}
+
+func (stdLogger) Println(v ...interface{}) {
+	//errors of writing logs cannot be logged.
+	_ = log.Output(2, fmt.Sprintln(v...))
+}
+
+//DefaultRedactHeaders are the headers whose values are redacted in logs if
+//RedactHeaders of Server or Client is nil.
+var DefaultRedactHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+//redacted is the value of redacted headers in logs.
+const redacted = "[REDACTED]"
+
+//redactHeader returns h whose values of headers are replaced with redacted for
+//logging, or DefaultRedactHeaders if headers is nil. h is copied if any header
+//is replaced.
+func redactHeader(h http.Header, headers []string) http.Header {
+	if headers == nil {
+		headers = DefaultRedactHeaders
+	}
+	var c http.Header
+	for _, k := range headers {
+		k = http.CanonicalHeaderKey(k)
+		if _, ok := h[k]; !ok {
 			continue
 		}
-		if director != nil {
-			director(re)
+		if c == nil {
+			c = h.Clone()
 		}
-		var w ResponseWriter
-		serveHTTP(&w, re)
-		if err := websocket.JSON.Send(clientWS, &w); err != nil {
-			close(err, closed)
-			return
+		c[k] = []string{redacted}
+	}
+	if c == nil {
+		return h
+	}
+	return c
+}
+
+//redacted returns the copy of r for logging, whose headers are redacted by
+//redactHeader.
+func (r *request) redacted(headers []string) *request {
+	c := *r
+	c.Header = redactHeader(r.Header, headers)
+	c.Trailer = redactHeader(r.Trailer, headers)
+	c.URL = redactURI(r.URL)
+	c.RequestURI = redactURI(r.RequestURI)
+	return &c
+}
+
+//redactURI returns uri without the userinfo if it is an absolute URL.
+func redactURI(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.User != nil {
+		return redactURL(u).String()
+	}
+	return uri
+}
+
+//redactURL returns u without the userinfo, which may have passwords, for logging.
+//u is copied if it has the userinfo.
+func redactURL(u *url.URL) *url.URL {
+	if u == nil || u.User == nil {
+		return u
+	}
+	c := *u
+	c.User = nil
+	return &c
+}
+
+//NopLogger is Logger which discards logs, e.g. for silencing DebugLogger.
+type NopLogger struct{}
+
+//Println does nothing.
+func (NopLogger) Println(v ...interface{}) {}
+
+//orStd returns l, or the standard logger if l is nil.
+func orStd(l Logger) Logger {
+	if l == nil {
+		return stdLogger{}
+	}
+	return l
+}
+
+//RefusedError is returned by Serve of Client when the relay server refuses it.
+type RefusedError struct {
+	//Reason is the reason sent by the relay server.
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "refused by relay server: " + e.Reason
+}
+
+//refuse tells the peer the reason why it is refused and closes c.
+func (c *conn) refuse(reason error) {
+	if err := c.send(&request{Refused: reason.Error()}); err != nil {
+		c.logger.Println(err)
+	}
+	if err := c.Close(); err != nil {
+		c.logger.Println(err)
+	}
+}
+
+//Close codes of CloseError defined in RFC 6455.
+const (
+	//CloseNoStatus is the code when the connection is closed without status code.
+	CloseNoStatus = 1005
+	//CloseAbnormal is the code when the connection is closed without close frame.
+	CloseAbnormal = 1006
+)
+
+//CloseError is the error which closed the websocket connection, passed to
+//OnDisconnect of Server and Client.
+//golang.org/x/net/websocket discards the payload of close frames, so the code and
+//reason sent by the peer are not known. Code is CloseNoStatus if the connection
+//is closed by the peer, including with close frames, and CloseAbnormal if it is
+//broken by a network error.
+type CloseError struct {
+	Code int
+	Err  error
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket is closed with %d: %v", e.Code, e.Err)
+}
+
+//Unwrap returns the underlying error.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+//ProtocolError is the error of a malformed frame received from the peer, e.g.
+//which cannot be decoded, passed to OnDisconnect of Server and Client.
+//Unlike CloseError, it means that the peer is broken or incompatible.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return "malformed frame: " + e.Err.Error()
+}
+
+//Unwrap returns the underlying error.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+//logDisconnect logs err which stopped reading a connection. Protocol errors are
+//logged loudly, because they are not usual unlike closes.
+func logDisconnect(logger Logger, err error) {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		logger.Println("PROTOCOL ERROR: closing the connection, the peer may be broken or incompatible:", err)
+		return
+	}
+	logger.Println(err)
+}
+
+//closeError wraps err of reading or writing websocket with CloseError if it closed
+//the connection.
+func closeError(err error) error {
+	var ne net.Error
+	switch {
+	case err == io.EOF:
+		return &CloseError{Code: CloseNoStatus, Err: err}
+	case errors.As(err, &ne):
+		return &CloseError{Code: CloseAbnormal, Err: err}
+	}
+	return err
+}
+
+//conn is a websocket connection whose deadlines are renewed on every frame.
+//Frames are JSON in text frames, or flags and payloads encoded by codec in binary
+//frames when they are compressed or not JSON.
+type conn struct {
+	*websocket.Conn
+	deadlines Deadlines
+	logger    Logger
+	//debug is the logger of verbose logs.
+	debug Logger
+	//codec is JSON if nil.
+	codec Codec
+	//compress is 1 if frames are sent with gzip.
+	compress int32
+	//features is the bits of the features which can be used with the peer, by
+	//indices in featureNames.
+	features uint32
+	//batch is frames in a received batch which are not read yet.
+	batch [][]byte
+	//wmutex serializes writes, which are made by goroutines serving requests in
+	//relay clients. Relay servers write only in writePump.
+	wmutex sync.Mutex
+}
+
+//setCompress makes c send frames with gzip.
+//It must be called only when the peer supports it.
+func (c *conn) setCompress() {
+	atomic.StoreInt32(&c.compress, 1)
+}
+
+//compressed returns true if c sends frames with gzip, which requires that gzip
+//can be used with the peer.
+func (c *conn) compressed() bool {
+	return atomic.LoadInt32(&c.compress) == 1 && c.has(featureGzip)
+}
+
+//setFeatures sets the features which can be used with the peer, e.g. the ones
+//negotiated in the handshake.
+func (c *conn) setFeatures(features []string) {
+	var bits uint32
+	for i, n := range featureNames {
+		for _, f := range features {
+			if f == n {
+				bits |= 1 << uint(i)
+			}
 		}
-		log.Println("sent resp to websocket", re)
 	}
+	atomic.StoreUint32(&c.features, bits)
 }
 
-//HandleClient connects to relayURL with websocket , reads requests and passes to
-//serveMux, and write its response to websocket.
-func HandleClient(relayURL, origin string, serveHTTP http.HandlerFunc, closed chan struct{}, director func(*http.Request)) error {
-	if clientWS != nil {
-		log.Println("closing openned websocket")
-		if err := clientWS.Close(); err != nil {
-			log.Println(err)
+//has returns true if feature can be used with the peer.
+func (c *conn) has(feature string) bool {
+	bits := atomic.LoadUint32(&c.features)
+	for i, n := range featureNames {
+		if n == feature {
+			return bits&(1<<uint(i)) != 0
 		}
 	}
-	var err error
-	clientWS, err = websocket.Dial(relayURL, "", origin)
+	return false
+}
+
+//getCodec returns the codec of c.
+func (c *conn) getCodec() Codec {
+	if c.codec == nil {
+		return JSON
+	}
+	return c.codec
+}
+
+//send sends v within the write deadline.
+func (c *conn) send(v interface{}) error {
+	data, err := c.getCodec().Encode(v)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	setDeadlines(clientWS)
-	go readClient(serveHTTP, closed, director)
+	return c.write(0, data, worthCompressing(v, len(data)))
+}
+
+//maxBatchBytes is the max size of payloads of batches. Larger frames are sent alone.
+const maxBatchBytes = 64 * 1024
+
+//sendBatch sends vs with batches of frames, each of which is prefixed with its
+//length.
+func (c *conn) sendBatch(vs []interface{}) error {
+	if len(vs) == 1 {
+		return c.send(vs[0])
+	}
+	var buf []byte
+	n := 0
+	compress := false
+	flush := func() error {
+		var err error
+		switch n {
+		case 0:
+		case 1:
+			//a batch of one frame is sent as a normal frame.
+			_, l := binary.Uvarint(buf)
+			err = c.write(0, buf[l:], compress && len(buf) >= compressThreshold)
+		default:
+			err = c.write(flagBatch, buf, compress && len(buf) >= compressThreshold)
+		}
+		buf, n, compress = nil, 0, false
+		return err
+	}
+	var size [binary.MaxVarintLen64]byte
+	for _, v := range vs {
+		data, err := c.getCodec().Encode(v)
+		if err != nil {
+			return err
+		}
+		if len(buf)+len(data) > maxBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(data)))]...)
+		buf = append(buf, data...)
+		n++
+		compress = compress || worthCompressing(v, compressThreshold)
+	}
+	return flush()
+}
+
+//write writes data encoded by the codec to websocket with flags within the write
+//deadline. data is gzipped if compress is true and the peer accepts it.
+func (c *conn) write(flags byte, data []byte, compress bool) error {
+	f := rawFrame{
+		data: data,
+	}
+	switch {
+	case c.compressed() && compress:
+		var buf bytes.Buffer
+		buf.WriteByte(flags | flagGzip)
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		f.data = buf.Bytes()
+		f.binary = true
+	case flags != 0 || c.getCodec().Name() != JSON.Name():
+		f.data = append([]byte{flags}, data...)
+		f.binary = true
+	}
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	if err := c.SetWriteDeadline(time.Now().Add(c.deadlines.write())); err != nil {
+		return err
+	}
+	return rawCodec.Send(c.Conn, f)
+}
+
+//receive receives a frame into v within the read deadline.
+//Once a gzipped frame is received, c sends frames with gzip too.
+//Frames in a batch are received one by one.
+func (c *conn) receive(v interface{}) error {
+	if len(c.batch) > 0 {
+		data := c.batch[0]
+		c.batch = c.batch[1:]
+		return c.decode(data, v)
+	}
+	if err := c.SetReadDeadline(time.Now().Add(c.deadlines.read())); err != nil {
+		return err
+	}
+	var f rawFrame
+	if err := rawCodec.Receive(c.Conn, &f); err != nil {
+		var pe *websocket.ProtocolError
+		if errors.As(err, &pe) {
+			return &ProtocolError{Err: err}
+		}
+		return err
+	}
+	if !f.binary {
+		return c.decode(f.data, v)
+	}
+	if len(f.data) == 0 {
+		return &ProtocolError{Err: errBadFrame}
+	}
+	data := f.data[1:]
+	if f.data[0]&flagGzip != 0 {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return &ProtocolError{Err: err}
+		}
+		//limit the decompressed size as well as the frame size.
+		var r io.Reader = zr
+		if c.MaxPayloadBytes > 0 {
+			r = io.LimitReader(zr, int64(c.MaxPayloadBytes)+1)
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return &ProtocolError{Err: err}
+		}
+		if c.MaxPayloadBytes > 0 && len(data) > c.MaxPayloadBytes {
+			return websocket.ErrFrameTooLarge
+		}
+		c.setCompress()
+	}
+	if f.data[0]&flagBatch != 0 {
+		batch, err := splitBatch(data)
+		if err != nil {
+			return &ProtocolError{Err: err}
+		}
+		data, c.batch = batch[0], batch[1:]
+	}
+	return c.decode(data, v)
+}
+
+//decode decodes data into v with the codec of c, and returns ProtocolError if it
+//fails.
+func (c *conn) decode(data []byte, v interface{}) error {
+	if err := c.getCodec().Decode(data, v); err != nil {
+		return &ProtocolError{Err: err}
+	}
 	return nil
 }
+
+//splitBatch splits the payload of a batch into frames.
+func splitBatch(data []byte) ([][]byte, error) {
+	var batch [][]byte
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, errBadFrame
+		}
+		batch = append(batch, data[n:n+int(l)])
+		data = data[n+int(l):]
+	}
+	if len(batch) == 0 {
+		return nil, errBadFrame
+	}
+	return batch, nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//Package relaytest provides a relay server and relay clients connected over
+//loopback websockets for tests of packages using http-relay.
+package relaytest
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	relay "github.com/shingetsu-gou/http-relay"
+)
+
+//ReadyTimeout is the max time for Connect to wait for relay clients to get ready.
+var ReadyTimeout = 10 * time.Second
+
+//Relay is a relay server listening on a loopback address.
+//Requests to URL(name) are relayed to the relay client connected as name
+//without the prefix of the name in their paths.
+type Relay struct {
+	//Server is the relay server.
+	Server *relay.Server
+	//Listener is the http server of Server.
+	Listener *httptest.Server
+}
+
+//New starts a relay server of s, or of relay.NewServer() if s is nil.
+//The caller should call Close when finished.
+func New(s *relay.Server) *Relay {
+	if s == nil {
+		s = relay.NewServer()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ws", s.WebsocketHandler(relay.RequestedName))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		name, path := split(r.URL.Path)
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = path
+		r.URL.RawPath = ""
+		s.HandleServer(name, w, r, nil)
+	})
+	return &Relay{
+		Server:   s,
+		Listener: httptest.NewServer(mux),
+	}
+}
+
+//split splits path into the name of the first segment and the rest.
+func split(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i:]
+	}
+	return path, "/"
+}
+
+//URL returns the base URL of requests relayed to the relay client connected
+//as name, e.g. URL("app")+"/hello" is relayed as "/hello".
+func (r *Relay) URL(name string) string {
+	return r.Listener.URL + "/" + name
+}
+
+//WebsocketURL returns the URL of websocket to which relay clients connect.
+func (r *Relay) WebsocketURL() string {
+	return "ws" + strings.TrimPrefix(r.Listener.URL, "http") + "/ws"
+}
+
+//Connect connects a relay client serving with h as name, and waits until it gets
+//ready for ReadyTimeout. stop disconnects the relay client and waits until it
+//stops serving.
+func (r *Relay) Connect(name string, h http.Handler) (stop func(), err error) {
+	return r.ConnectClient(&relay.Client{}, name, h)
+}
+
+//ConnectClient is Connect with the relay client c, e.g. for testing options of
+//relay clients. The name of c is overwritten with name.
+func (r *Relay) ConnectClient(c *relay.Client, name string, h http.Handler) (stop func(), err error) {
+	c.Name = name
+	if err := c.Dial(r.WebsocketURL(), "http://localhost/"); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := c.ServeHandler(h, nil, nil); err != nil {
+			r.log(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+	defer cancel()
+	stop = func() {
+		if err := c.Close(); err != nil {
+			r.log(err)
+		}
+		<-done
+	}
+	if err := r.Server.WaitReady(ctx, name); err != nil {
+		stop()
+		return nil, err
+	}
+	return stop, nil
+}
+
+//log logs err with the logger of Server.
+func (r *Relay) log(err error) {
+	if r.Server.Logger == nil {
+		log.Println(err)
+		return
+	}
+	r.Server.Logger.Println(err)
+}
+
+//Close shuts down the relay server and its http server.
+func (r *Relay) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout)
+	defer cancel()
+	if err := r.Server.Shutdown(ctx); err != nil {
+		r.log(err)
+	}
+	r.Listener.Close()
+}
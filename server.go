@@ -0,0 +1,2059 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var errStopped = errors.New("relay is stopped")
+var errDropped = errors.New("relay is dropped")
+var errOrigin = errors.New("origin is not allowed")
+var errEvicted = errors.New("evicted by a new connection")
+var errNoPong = errors.New("pong is not received")
+var errIdle = errors.New("no frame is received")
+
+//Errors returned by HandleServerE, which tell why the request is not relayed.
+var (
+	//ErrShutdown is returned after Shutdown is called. It is also passed to
+	//OnDisconnect of relay clients closed by Shutdown.
+	ErrShutdown = errors.New("relay server is shut down")
+	//ErrNoRelay is returned if no relay client is registered as the name.
+	ErrNoRelay = errors.New("relay client is not connected")
+	//ErrRelayClosed is returned if the relay client is disconnected while relaying.
+	ErrRelayClosed = errors.New("relay client is disconnected")
+	//ErrTimeout is returned if the response is not received within RequestTimeout.
+	ErrTimeout = errors.New("relay client timed out")
+	//ErrQueueFull is returned if the queue to the relay client is full.
+	ErrQueueFull = errors.New("relay client is busy")
+	//ErrResponseTooLarge is returned if the response body exceeds MaxBodyBytes.
+	ErrResponseTooLarge = errors.New("response body too large")
+	//ErrRateLimited is returned if the request exceeds RateLimit.
+	ErrRateLimited = errors.New("too many requests")
+	//ErrTooManyInFlight is returned if the relay client has MaxConcurrentRequests
+	//in-flight requests.
+	ErrTooManyInFlight = errors.New("too many in-flight requests")
+	//ErrNameConflict is the reason why relay clients are refused if their names
+	//conflict with registered ones by RejectPrefixConflicts.
+	ErrNameConflict = errors.New("name conflicts with a registered name by prefix")
+	//ErrDenied is returned if the response is denied by doAccept.
+	ErrDenied = errors.New("response is denied")
+	//ErrCanceled is returned if the request is canceled by CancelRequest.
+	ErrCanceled = errors.New("request is canceled by the relay server")
+	//ErrDuplicateName is the reason why relay clients are refused if their names
+	//are already registered by RejectNew.
+	ErrDuplicateName = errors.New("name is already registered")
+	//ErrNotSupported is returned if the relay client doesn't support the feature
+	//required by the request, e.g. tunnels.
+	ErrNotSupported = errors.New("not supported by the relay client")
+)
+
+//DuplicateNamePolicy is what the relay server does when a relay client connects
+//with a name which is already registered.
+type DuplicateNamePolicy int
+
+const (
+	//EvictOld closes the old relay client and registers the new one.
+	EvictOld DuplicateNamePolicy = iota
+	//RejectNew refuses the new relay client with *RefusedError of ErrDuplicateName,
+	//leaving the old one untouched, for deployments where duplicate names are
+	//misconfigurations.
+	RejectNew
+	//AllowMulti registers both of them like LoadBalance.
+	AllowMulti
+)
+
+//Server relays http requests to relay clients connected with websocket.
+type Server struct {
+	//Deadlines are timeouts of connections to relay clients.
+	Deadlines Deadlines
+	//PingInterval is the interval of pings to relay clients. It should be shorter
+	//than Deadlines.Read of relay clients. One minute is used if zero.
+	PingInterval time.Duration
+	//PongTimeout is the time to wait for a pong after sending a ping.
+	//PingInterval is used if zero.
+	PongTimeout time.Duration
+	//NativePing sends pings as websocket ping frames, which keep intermediaries
+	//alive without frames in the data channel. x/net/websocket replies pongs to
+	//them but doesn't expose received pongs, nor renew read deadlines with them,
+	//so pings in the data channel are still sent while no frame is received for
+	//half of Deadlines.Read, and their pongs are waited for PongTimeout.
+	NativePing bool
+	//IdlePings is the # of PingInterval to wait for any frame, including pongs,
+	//from relay clients. Silent connections are closed and deregistered after it.
+	//3 is used if zero.
+	IdlePings int
+	//RequestTimeout is the time to wait for the response of a relayed request.
+	//It is independent of Deadlines. No timeout if zero.
+	RequestTimeout time.Duration
+	//MaxBodyBytes is the max size of bodies of requests and responses. Requests with
+	//larger bodies are responded with 413, and larger responses with 502.
+	//It also limits the size of frames from relay clients, so that connections
+	//sending larger frames are closed before buffering them.
+	//No limit if zero, which is the default.
+	MaxBodyBytes int64
+	//MaxFrameBytes is the max size of frames from relay clients, which overrides
+	//the one derived from MaxBodyBytes. Connections sending larger frames are closed
+	//before buffering them. websocket.DefaultMaxPayloadBytes (32MB) is used if both
+	//are zero.
+	MaxFrameBytes int
+	//HandshakeTimeout is the max time for websocket handshakes of relay clients in
+	//WebsocketHandler after their requests are read, which are bounded by
+	//ReadHeaderTimeout of http.Server. It is 10 seconds if zero.
+	HandshakeTimeout time.Duration
+	//MaxInMemoryBody is the max size of request bodies which are read into memory
+	//and sent with the request at once. Larger bodies and ones with unknown size are
+	//streamed by chunks. Bodies are never streamed if zero.
+	MaxInMemoryBody int64
+	//Compress enables gzip compression of frames with clients which offer it.
+	//Frames are not compressed with other clients.
+	Compress bool
+	//Codec is the codec of frames. Clients with other codecs are refused.
+	//JSON is used if nil.
+	Codec Codec
+	//Authenticate authenticates ws in StartServe and returns the name which ws is
+	//registered as instead of the one passed to StartServe. ws is refused if ok
+	//is false. All connections are accepted with the passed names if nil.
+	//The name requested by the relay client is RequestedName(ws.Request()), which
+	//can be accepted or rewritten.
+	Authenticate func(ws *websocket.Conn) (name string, ok bool)
+	//OnConnect is called when a relay client is registered as name if not nil.
+	OnConnect func(name string)
+	//OnDisconnect is called with the error which stopped the relay when the relay
+	//client registered as name is disconnected if not nil. The error is
+	//*CloseError if the connection is closed or broken, or *ProtocolError if a
+	//malformed frame is received.
+	OnDisconnect func(name string, err error)
+	//OnEvict is called when the relay client registered as name is evicted by a new
+	//connection with the same name if not nil.
+	OnEvict func(name string)
+	//Logger is the destination of logs. The standard logger of package log is used
+	//if nil.
+	Logger Logger
+	//DebugLogger is the destination of verbose logs of each step of relaying, e.g.
+	//sending requests and pings. Logger is used if nil, and NopLogger silences them.
+	DebugLogger Logger
+	//AccessLog is called with the entry of each request relayed by HandleServer
+	//when it finishes if not nil.
+	AccessLog func(entry AccessEntry)
+	//RedactHeaders are the headers whose values are redacted in logs of requests,
+	//while they are relayed as is. DefaultRedactHeaders is used if nil, and nothing
+	//is redacted if empty.
+	RedactHeaders []string
+	//Metrics receives metrics of requests and connections if not nil.
+	Metrics Metrics
+	//Tracer traces relayed requests if not nil.
+	Tracer Tracer
+	//LoadBalance allows multiple relay clients to be registered with the same name.
+	//Requests are relayed to the one with the least in-flight requests, and retried
+	//with another one if it is disconnected. Requests which may have been processed
+	//are retried only if they are idempotent or have an Idempotency-Key or
+	//X-Idempotency-Key header like net/http, and are responded with 502 otherwise.
+	//Otherwise a new relay client is handled by DuplicateNames.
+	LoadBalance bool
+	//DuplicateNames is what to do when a relay client connects with a registered
+	//name without LoadBalance, which is EvictOld by default.
+	DuplicateNames DuplicateNamePolicy
+	//ReconnectWindow is the time to hold requests whose relay clients are
+	//disconnected while processing them, until a relay client with the same name
+	//reconnects, e.g. ServeReconnect after a blip. Held requests are relayed again
+	//to the new one, or responded with 502 after the window. Only requests which
+	//can be retried like LoadBalance are held, so non-idempotent ones and ones
+	//with streamed bodies are never replayed. Handlers of replayed requests may
+	//run twice, and the first run may still be in progress when the second
+	//starts, so they must tolerate it. The relay server is where requests are
+	//held, because responses from a relay client can't be delivered over its new
+	//connection. Requests are not held if zero.
+	ReconnectWindow time.Duration
+	//MinProtocolVersion is the lowest ProtocolVersion of relay clients which are
+	//allowed. Relay clients with lower ones are refused with *RefusedError after
+	//the handshake. If it is higher than 1, requests are relayed only to relay
+	//clients which completed the handshake, and ones which don't complete it within
+	//PongTimeout, e.g. legacy ones which never send Ready, are refused too. All are
+	//allowed if zero.
+	MinProtocolVersion int
+	//RejectPrefixConflicts refuses relay clients whose names are strict prefixes of
+	//registered names or prefixed by them, e.g. "api" and "api.v2", which are
+	//ambiguous for prefixes of IsAccepted. Refused clients get *RefusedError.
+	RejectPrefixConflicts bool
+	//ResponseHeaderPolicy drops or rewrites headers of responses from the relay
+	//client registered as name in h before they are written, e.g. Set-Cookie for
+	//the domain of the relay server, if not nil. StripHeaders drops headers.
+	ResponseHeaderPolicy func(name string, h http.Header)
+	//CheckOrigin returns true if the origin of the websocket request r from a relay
+	//client is allowed in WebsocketHandler. All origins are allowed if nil, which
+	//lets any web page open a relay connection from the browsers of its visitors,
+	//so it should be set when the websocket endpoint is reachable from browsers.
+	CheckOrigin func(r *http.Request) bool
+	//Instance returns the instance ID of the relay client to which r is relayed,
+	//e.g. from a cookie, for sticky sessions with LoadBalance. r is relayed to the
+	//one advertising the ID with Client.InstanceID, or balanced as usual if the ID
+	//is empty or no one has it. Requests are always balanced if nil.
+	Instance func(r *http.Request) string
+	//ForwardHeaders adds the address of the original client to X-Forwarded-For, and
+	//sets X-Forwarded-Proto and X-Forwarded-Host of relayed requests.
+	//RemoteAddr of relayed requests is the original one regardless of it.
+	ForwardHeaders bool
+	//QueueDepth is the max # of frames queued to be sent to a relay client.
+	//Requests are responded with 503 when the queue is full. It is 64 if zero.
+	QueueDepth int
+	//MaxConcurrentRequests is the max # of in-flight requests to a relay client.
+	//Requests over it are responded with 503 instead of being relayed. No limit if
+	//zero.
+	MaxConcurrentRequests int
+	//Tunnel enables tunneling CONNECT and upgrade requests, e.g. websocket, to relay
+	//clients, whose handlers hijack ResponseWriter to get the tunneled connection.
+	//Handlers can be websocket.Handler, which negotiate with the original clients
+	//and exchange frames through the tunnel until either side closes.
+	//They are relayed as normal requests if false.
+	Tunnel bool
+	//BatchInterval is the max time to wait for more frames to be sent with a queued
+	//one in a batch, which coalesces small frames into a websocket frame. Batching
+	//is disabled if zero, and with clients which don't support it.
+	BatchInterval time.Duration
+	//RateLimit is the max rate of requests per second to each name. Requests over it
+	//are responded with 429. No limit if zero.
+	RateLimit float64
+	//RateBurst is the max # of requests to each name at once over RateLimit.
+	//RateLimit rounded up is used if zero.
+	RateBurst int
+	//CacheBytes is the max total size of responses cached in memory, which are
+	//evicted in LRU order. Fresh responses to GET and HEAD requests as Cache-Control
+	//or Expires are served from the cache without relaying, with 304 if requests
+	//are conditional and not modified as ETag or Last-Modified. Responses are
+	//cached per name, method, URL and Vary headers, and not cached if private,
+	//with cookies or with flushed bodies. Cached responses to a URL are
+	//invalidated by succeeded unsafe requests to it. No cache if zero.
+	CacheBytes int64
+
+	sockets map[string][]*wsRelayServer
+	count   int32
+	mutex   sync.RWMutex
+	//next is the counter to rotate relay clients with the same load.
+	next uint32
+	//shutdown is true after Shutdown is called.
+	shutdown bool
+	//handling is the group of running HandleServer.
+	handling sync.WaitGroup
+	//readyc is closed and renewed when a relay client gets ready.
+	readyc chan struct{}
+	//limiter limits requests by RateLimit.
+	limiter rateLimiter
+	//cache caches responses up to CacheBytes.
+	cache responseCache
+	//lastID is the last ID of requests, which are unique in s so that
+	//CancelRequest finds them without connections.
+	lastID uint64
+	//newTicker and newTimer are replaced in tests.
+	newTicker func(time.Duration) *time.Ticker
+	newTimer  func(time.Duration) *time.Timer
+}
+
+//NewServer returns a new Server configured by opts.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		sockets: make(map[string][]*wsRelayServer),
+	}
+	for _, o := range opts {
+		o.applyServer(s)
+	}
+	return s
+}
+
+func (s *Server) queueDepth() int {
+	if s.QueueDepth <= 0 {
+		return 64
+	}
+	return s.QueueDepth
+}
+
+func (s *Server) pingInterval() time.Duration {
+	if s.PingInterval == 0 {
+		return time.Minute
+	}
+	return s.PingInterval
+}
+
+func (s *Server) pongTimeout() time.Duration {
+	if s.PongTimeout == 0 {
+		return s.pingInterval()
+	}
+	return s.PongTimeout
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	n := s.IdlePings
+	if n <= 0 {
+		n = 3
+	}
+	return time.Duration(n) * s.pingInterval()
+}
+
+//frameOverhead is the size of frames added to bodies for headers and base64
+//encoding.
+const frameOverhead = 64 * 1024
+
+//maxPayloadBytes returns the max size of frames from relay clients.
+//Bodies are base64 encoded in frames.
+func (s *Server) maxPayloadBytes() int {
+	if s.MaxFrameBytes > 0 {
+		return s.MaxFrameBytes
+	}
+	if s.MaxBodyBytes == 0 {
+		return 0
+	}
+	return int(s.MaxBodyBytes/3*4) + frameOverhead
+}
+
+//logger returns the logger of s.
+func (s *Server) logger() Logger {
+	return orStd(s.Logger)
+}
+
+//debug returns the logger of verbose logs of s.
+func (s *Server) debug() Logger {
+	if s.DebugLogger == nil {
+		return s.logger()
+	}
+	return s.DebugLogger
+}
+
+//metrics returns the metrics of s.
+func (s *Server) metrics() Metrics {
+	if s.Metrics == nil {
+		return NopMetrics{}
+	}
+	return s.Metrics
+}
+
+//DefaultServer is the Server used by StartServe, StopServe, HandleServer, Count,
+//IsAccepted, ListNames and Shutdown.
+var DefaultServer = NewServer()
+
+type wsRelayServer struct {
+	logger  Logger
+	ws      *conn
+	msg     chan interface{}
+	done    chan struct{}
+	once    sync.Once
+	err     error
+	pong    chan struct{}
+	pmutex  sync.Mutex
+	pending map[uint64]chan *ResponseWriter
+	//streams are flushed responses being received.
+	streams map[uint64]*bodyStream
+	//recv is signaled every time a frame is received.
+	recv chan struct{}
+	//server is the server with which r is registered as name.
+	server *Server
+	name   string
+	//batch is BatchInterval if the relay client supports batches.
+	batch time.Duration
+	//instance is the instance ID advertised by the relay client.
+	instance string
+	//remoteAddr is the network address of the relay client.
+	remoteAddr string
+	//ready is 1 after the relay client tells that it starts serving, or 2 after it
+	//is refused in the handshake.
+	ready int32
+	//version is the protocol version negotiated in the handshake.
+	version int32
+	//features is the features supported by the relay server for the relay client.
+	features []string
+	//refused is the error why the relay client is refused in the handshake, which
+	//closes the connection after the refusal is sent.
+	refused error
+	//lastPong is the unix time in nanoseconds when the last pong is received.
+	lastPong int64
+	//lastRecv is the unix time in nanoseconds when the last frame is received.
+	lastRecv int64
+	//lastSend is the unix time in nanoseconds when the last frame is sent.
+	lastSend int64
+	//connectedAt is when the relay client is connected.
+	connectedAt time.Time
+	//nativePing is true if pings are sent as websocket ping frames while frames
+	//are received.
+	nativePing bool
+}
+
+//frame is a message from relay client, which is a response or a reply of ping.
+type frame struct {
+	ResponseWriter
+	IsPing bool
+	//Ready is true if the relay client starts serving.
+	Ready bool
+	//Version and Features are the protocol version and features of the relay
+	//client, sent with Ready.
+	Version  int
+	Features []string
+}
+
+//Count returns # of relay clients of DefaultServer.
+//
+//Deprecated: It only reflects DefaultServer. Use (*Server).Count instead.
+func Count() int32 {
+	return DefaultServer.Count()
+}
+
+//Count returns # of relay clients.
+func (s *Server) Count() int32 {
+	return atomic.LoadInt32(&s.count)
+}
+
+//IsAccepted retruns true if prefix is already accepted by DefaultServer.
+//
+//Deprecated: It only reflects DefaultServer. Use (*Server).IsAccepted instead.
+func IsAccepted(prefix string) bool {
+	return DefaultServer.IsAccepted(prefix)
+}
+
+//conflict returns the registered name which conflicts with name by prefix if
+//RejectPrefixConflicts is true. s.mutex must be locked.
+func (s *Server) conflict(name string) (string, bool) {
+	if !s.RejectPrefixConflicts {
+		return "", false
+	}
+	for n := range s.sockets {
+		if n != name && (strings.HasPrefix(n, name) || strings.HasPrefix(name, n)) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+//IsAccepted retruns true if prefix is already accepted.
+func (s *Server) IsAccepted(prefix string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for n := range s.sockets {
+		if strings.HasPrefix(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//InFlight returns # of in-flight requests to the relay clients registered as
+//name to DefaultServer.
+func InFlight(name string) int {
+	return DefaultServer.InFlight(name)
+}
+
+//InFlight returns # of in-flight requests to the relay clients registered as name.
+func (s *Server) InFlight(name string) int {
+	s.mutex.RLock()
+	ws := s.sockets[name]
+	s.mutex.RUnlock()
+	n := 0
+	for _, w := range ws {
+		n += w.inflight()
+	}
+	return n
+}
+
+//inflightIDs returns IDs of requests waiting for responses.
+func (r *wsRelayServer) inflightIDs() []uint64 {
+	r.pmutex.Lock()
+	defer r.pmutex.Unlock()
+	ids := make([]uint64, 0, len(r.pending)+len(r.streams))
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	for id := range r.streams {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+//InFlightIDs returns the sorted IDs of in-flight requests to the relay clients
+//registered as name to DefaultServer.
+func InFlightIDs(name string) []string {
+	return DefaultServer.InFlightIDs(name)
+}
+
+//InFlightIDs returns the sorted IDs of in-flight requests to the relay clients
+//registered as name, which are also in AccessEntry and can be canceled by
+//CancelRequest.
+func (s *Server) InFlightIDs(name string) []string {
+	s.mutex.RLock()
+	ws := s.sockets[name]
+	s.mutex.RUnlock()
+	var ids []uint64
+	for _, w := range ws {
+		ids = append(ids, w.inflightIDs()...)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatUint(id, 10)
+	}
+	return strs
+}
+
+//CancelRequest cancels the in-flight request with id to the relay clients
+//registered as name in DefaultServer.
+func CancelRequest(name string, id string) bool {
+	return DefaultServer.CancelRequest(name, id)
+}
+
+//CancelRequest cancels the in-flight request with id to the relay clients
+//registered as name, e.g. which is stuck. The context of the relayed request is
+//canceled in the relay client, and HandleServer relaying it is responded with 503
+//and ErrCanceled, or aborted if the response is already flushed.
+//It returns false if the request is not in flight, or if the queue to the relay
+//client stays full so that the cancellation can't be sent.
+func (s *Server) CancelRequest(name string, id string) bool {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return false
+	}
+	s.mutex.RLock()
+	ws := s.sockets[name]
+	s.mutex.RUnlock()
+	for _, w := range ws {
+		if w.cancel(n) {
+			s.logger().Println("request is canceled", name, id)
+			return true
+		}
+	}
+	return false
+}
+
+//RemoteAddr returns the network address of the first relay client registered
+//as name to DefaultServer.
+func RemoteAddr(name string) (string, bool) {
+	return DefaultServer.RemoteAddr(name)
+}
+
+//RemoteAddr returns the network address of the first relay client registered as name.
+//It returns false if name is not registered.
+func (s *Server) RemoteAddr(name string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ws := s.sockets[name]
+	if len(ws) == 0 {
+		return "", false
+	}
+	return ws[0].remoteAddr, true
+}
+
+//ListNames returns the sorted names of relay clients of DefaultServer.
+func ListNames() []string {
+	return DefaultServer.ListNames()
+}
+
+//ListNames returns the sorted names of relay clients.
+func (s *Server) ListNames() []string {
+	s.mutex.RLock()
+	names := make([]string, 0, len(s.sockets))
+	for n := range s.sockets {
+		names = append(names, n)
+	}
+	s.mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout == 0 {
+		return 10 * time.Second
+	}
+	return s.HandshakeTimeout
+}
+
+//WebsocketHandler returns the handler of websocket requests from relay clients, which
+//checks their origins with CheckOrigin and starts to relay them as the names
+//returned by name. Handshakes are stopped after HandshakeTimeout.
+func (s *Server) WebsocketHandler(name func(r *http.Request) string) http.Handler {
+	ws := websocket.Server{
+		Handshake: s.handshake,
+		Handler: func(ws *websocket.Conn) {
+			//deadlines of the handshake are replaced by Deadlines.
+			if err := ws.SetDeadline(time.Time{}); err != nil {
+				s.logger().Println(err)
+			}
+			s.StartServe(name(ws.Request()), ws)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//deadlines are kept by the connection after it is hijacked.
+		if err := setDeadline(w, time.Now().Add(s.handshakeTimeout())); err != nil {
+			s.logger().Println(err)
+		}
+		ws.ServeHTTP(w, r)
+	})
+}
+
+//deadliner is http.ResponseWriter which supports deadlines, e.g. of net/http since
+//Go 1.20.
+type deadliner interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+//setDeadline sets the read and write deadlines of w or of the one unwrapped from it
+//like http.ResponseController. Writers which don't support them are ignored.
+func setDeadline(w http.ResponseWriter, deadline time.Time) error {
+	for {
+		if d, ok := w.(deadliner); ok {
+			err := d.SetReadDeadline(deadline)
+			if err == nil {
+				err = d.SetWriteDeadline(deadline)
+			}
+			if errors.Is(err, http.ErrNotSupported) {
+				return nil
+			}
+			return err
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+//handshake refuses websocket requests whose origins are not allowed.
+func (s *Server) handshake(config *websocket.Config, r *http.Request) error {
+	if s.CheckOrigin != nil && !s.CheckOrigin(r) {
+		return errOrigin
+	}
+	return nil
+}
+
+//AllowOrigins returns a function for Server.CheckOrigin which allows only origins.
+func AllowOrigins(origins ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//StripHeaders returns a function for Server.ResponseHeaderPolicy which drops
+//headers from responses of all relay clients.
+func StripHeaders(headers ...string) func(name string, h http.Header) {
+	return func(name string, h http.Header) {
+		for _, k := range headers {
+			h.Del(k)
+		}
+	}
+}
+
+//StartServe starts to relay with DefaultServer.
+func StartServe(name string, ws *websocket.Conn) {
+	DefaultServer.StartServe(name, ws)
+}
+
+//StartServe starts to relay.
+//It registers ws connection as name and wait until the relay is stopped.
+func (s *Server) StartServe(name string, ws *websocket.Conn) {
+	if s.Authenticate != nil {
+		var ok bool
+		if name, ok = s.Authenticate(ws); !ok {
+			s.logger().Println("refused unauthenticated connection")
+			if err := ws.Close(); err != nil {
+				s.logger().Println(err)
+			}
+			return
+		}
+	}
+	codec := JSON.Name()
+	if ws.Request() != nil && ws.Request().URL.Query().Get(codecQuery) != "" {
+		codec = ws.Request().URL.Query().Get(codecQuery)
+	}
+	if codec != codecName(s.Codec) {
+		s.logger().Println("refused codec", codec, "of", name)
+		if err := ws.Close(); err != nil {
+			s.logger().Println(err)
+		}
+		return
+	}
+	w := &wsRelayServer{
+		server: s,
+		name:   name,
+		logger: s.logger(),
+		ws: &conn{
+			Conn:      ws,
+			deadlines: s.Deadlines,
+			logger:    s.logger(),
+			debug:     s.debug(),
+			codec:     s.Codec,
+		},
+		msg:     make(chan interface{}, s.queueDepth()),
+		done:    make(chan struct{}),
+		pong:    make(chan struct{}, 1),
+		recv:    make(chan struct{}, 1),
+		pending: make(map[uint64]chan *ResponseWriter),
+	}
+	w.connectedAt = time.Now()
+	if ws.Request() != nil {
+		w.instance = ws.Request().URL.Query().Get(instanceQuery)
+		w.remoteAddr = ws.Request().RemoteAddr
+		if ws.Request().URL.Query().Get(batchQuery) != "" {
+			w.batch = s.BatchInterval
+		}
+		w.nativePing = s.NativePing
+	}
+	ws.MaxPayloadBytes = s.maxPayloadBytes()
+	compress := s.Compress && ws.Request() != nil &&
+		ws.Request().URL.Query().Get(compressQuery) == "gzip"
+	if compress {
+		//a gzipped ping tells the client that compression is accepted. It is
+		//queued first like all frames, which are written only by writePump.
+		w.ws.setCompress()
+		w.msg <- &request{IsPing: true}
+		w.features = append(w.features, featureGzip)
+	}
+	if w.batch > 0 {
+		w.features = append(w.features, featureBatch)
+	}
+	//gzip and batches are offered by the query, so they are used until the
+	//handshake tells the others.
+	w.ws.setFeatures(w.features)
+	w.features = append(w.features, featureStream)
+	if s.Tunnel {
+		w.features = append(w.features, featureTunnel)
+	}
+
+	s.mutex.Lock()
+	if s.shutdown {
+		s.mutex.Unlock()
+		s.logger().Println("refused connection while shutting down", name)
+		if err := ws.Close(); err != nil {
+			s.logger().Println(err)
+		}
+		return
+	}
+	if s.sockets == nil {
+		s.sockets = make(map[string][]*wsRelayServer)
+	}
+	if n, ok := s.conflict(name); ok {
+		s.mutex.Unlock()
+		s.logger().Println("refused connection", name, "conflicting with", n)
+		w.ws.refuse(ErrNameConflict)
+		return
+	}
+	var old []*wsRelayServer
+	switch {
+	case s.LoadBalance || s.DuplicateNames == AllowMulti:
+		s.sockets[name] = append(s.sockets[name], w)
+	case s.DuplicateNames == RejectNew && len(s.sockets[name]) > 0:
+		s.mutex.Unlock()
+		s.logger().Println("refused connection with duplicate name", name)
+		w.ws.refuse(ErrDuplicateName)
+		return
+	default:
+		old = s.sockets[name]
+		s.sockets[name] = []*wsRelayServer{w}
+	}
+	s.mutex.Unlock()
+	for _, o := range old {
+		o.close(errEvicted)
+		if s.OnEvict != nil {
+			s.OnEvict(name)
+		}
+	}
+	s.metrics().SetConnected(int(atomic.AddInt32(&s.count, 1)))
+	if s.OnConnect != nil {
+		s.OnConnect(name)
+	}
+	newTicker := s.newTicker
+	if newTicker == nil {
+		newTicker = time.NewTicker
+	}
+	newTimer := s.newTimer
+	if newTimer == nil {
+		newTimer = time.NewTimer
+	}
+	w.writePump(newTicker(s.pingInterval()), s.pongTimeout(), newTimer)
+	w.readPump()
+	w.idlePump(s.idleTimeout())
+	if s.MinProtocolVersion > 1 {
+		w.handshakePump(s.MinProtocolVersion, s.pongTimeout())
+	}
+
+	<-w.done
+	s.logger().Println("relay exited")
+	s.metrics().SetConnected(int(atomic.AddInt32(&s.count, -1)))
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(name, w.err)
+	}
+}
+
+//RequestedName returns the name which the relay client requests to be registered
+//as with Client.Name in the websocket request r, e.g. for WebsocketHandler. It
+//returns "" if r is nil.
+func RequestedName(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return r.URL.Query().Get(nameQuery)
+}
+
+//TokenAuth returns an authenticator for Server.Authenticate which accepts
+//connections with a token in tokens and names them as its value.
+//The token is read from "Authorization: Bearer <token>" header or "token" query
+//parameter of the websocket request.
+func TokenAuth(tokens map[string]string) func(*websocket.Conn) (string, bool) {
+	return func(ws *websocket.Conn) (string, bool) {
+		r := ws.Request()
+		if r == nil {
+			return "", false
+		}
+		token := r.URL.Query().Get("token")
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		}
+		if token == "" {
+			return "", false
+		}
+		for t, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return name, true
+			}
+		}
+		return "", false
+	}
+}
+
+//Shutdown shuts down DefaultServer gracefully.
+func Shutdown(ctx context.Context) error {
+	return DefaultServer.Shutdown(ctx)
+}
+
+//Shutdown shuts down s in the order which doesn't fail in-flight requests:
+//
+//  1. HandleServer refuses new requests with 503 and ErrShutdown, and new relay
+//     clients are refused.
+//  2. It waits for running HandleServer to finish until ctx is done, while their
+//     relay clients stay connected.
+//  3. It closes connections of all relay clients, whose OnDisconnect get
+//     ErrShutdown.
+//
+//It returns the error of ctx if it is done before all requests finish.
+//RegisterOnShutdown runs it when embedding http.Server shuts down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shutdown = true
+	s.mutex.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		s.handling.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	var all []*wsRelayServer
+	s.mutex.RLock()
+	for _, ws := range s.sockets {
+		all = append(all, ws...)
+	}
+	s.mutex.RUnlock()
+	for _, w := range all {
+		w.close(ErrShutdown)
+	}
+	return err
+}
+
+//RegisterOnShutdown makes Shutdown of hs, which serves both HandleServer and
+//relay clients of s, shut down s within timeout. hs stops accepting connections
+//and waits for in-flight requests, while s refuses requests on kept-alive
+//connections and closes relay clients after they are drained. Connections of relay
+//clients are hijacked, so hs doesn't wait for them. No timeout if zero.
+func (s *Server) RegisterOnShutdown(hs *http.Server, timeout time.Duration) {
+	hs.RegisterOnShutdown(func() {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := s.Shutdown(ctx); err != nil {
+			s.logger().Println(err)
+		}
+	})
+}
+
+//remove removes w from relay clients registered as name. s.mutex must be locked.
+func (s *Server) remove(name string, w *wsRelayServer) {
+	ws := s.sockets[name]
+	for i, o := range ws {
+		if o != w {
+			continue
+		}
+		if len(ws) == 1 {
+			delete(s.sockets, name)
+			return
+		}
+		rest := make([]*wsRelayServer, 0, len(ws)-1)
+		rest = append(rest, ws[:i]...)
+		s.sockets[name] = append(rest, ws[i+1:]...)
+		return
+	}
+}
+
+//pick returns the relay client registered as name which has the instance ID, or
+//the least in-flight requests except ones in tried, or nil if there is none.
+func (s *Server) pick(name, instance string, tried []*wsRelayServer) *wsRelayServer {
+	s.mutex.RLock()
+	ws := s.sockets[name]
+	s.mutex.RUnlock()
+	if len(ws) == 0 {
+		return nil
+	}
+	if instance != "" {
+		for _, w := range ws {
+			if w.instance == instance && !contains(tried, w) && s.handshaken(w) {
+				return w
+			}
+		}
+	}
+	start := int(atomic.AddUint32(&s.next, 1))
+	var best *wsRelayServer
+	min := 0
+	for i := range ws {
+		w := ws[(start+i)%len(ws)]
+		if contains(tried, w) {
+			continue
+		}
+		if !s.handshaken(w) {
+			continue
+		}
+		if n := w.inflight(); best == nil || n < min {
+			best, min = w, n
+		}
+	}
+	return best
+}
+
+//handshaken returns true if requests can be relayed to w, which must complete
+//the handshake if MinProtocolVersion is higher than 1, because it may be too old
+//until then.
+func (s *Server) handshaken(w *wsRelayServer) bool {
+	return s.MinProtocolVersion <= 1 || atomic.LoadInt32(&w.ready) == 1
+}
+
+//contains returns true if ws contains w.
+func contains(ws []*wsRelayServer, w *wsRelayServer) bool {
+	for _, o := range ws {
+		if o == w {
+			return true
+		}
+	}
+	return false
+}
+
+//StopServe stops relaying associated with name in DefaultServer.
+func StopServe(name string) {
+	DefaultServer.StopServe(name)
+}
+
+//StopServe stops relaying associated with name. All relay clients registered as
+//name are stopped with LoadBalance.
+func (s *Server) StopServe(name string) {
+	s.drop(name, errStopped)
+}
+
+//Drop disconnects all relay clients registered as name, and returns false if there
+//is none. They are deregistered when Drop returns, so it can be used by admin
+//handlers to evict misbehaving relay clients.
+func (s *Server) Drop(name string) bool {
+	return s.drop(name, errDropped)
+}
+
+//drop closes all relay clients registered as name with err.
+func (s *Server) drop(name string, err error) bool {
+	s.mutex.RLock()
+	ws := s.sockets[name]
+	s.mutex.RUnlock()
+	for _, w := range ws {
+		w.close(err)
+	}
+	return len(ws) > 0
+}
+
+//close stops relaying because of err, which is the only way to tear down r.
+//It deregisters r from its server, closes the connection, and cancels requests
+//waiting for responses, which are responded with ErrRelayClosed or retried.
+//It can be called many times, and only the first err is kept.
+func (r *wsRelayServer) close(err error) {
+	r.once.Do(func() {
+		r.err = err
+		if r.server != nil {
+			r.server.mutex.Lock()
+			r.server.remove(r.name, r)
+			r.server.mutex.Unlock()
+		}
+		if r.ws != nil {
+			if errc := r.ws.Close(); errc != nil {
+				r.logger.Println(errc)
+			}
+		}
+		r.cancelAll()
+		close(r.done)
+	})
+}
+
+//writePump writes requests and pings every tick of ticker to websocket.
+//Pongs are received by readPump, and the connection is stopped if the pong
+//is not received within pongTimeout, which is timed by a timer of newTimer.
+func (r *wsRelayServer) writePump(ticker *time.Ticker, pongTimeout time.Duration, newTimer func(time.Duration) *time.Timer) {
+	go func() {
+		defer ticker.Stop()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		for {
+			select {
+			case <-ticker.C:
+				if timer != nil {
+					continue
+				}
+				if r.recentlyReceived() {
+					if err := r.ws.sendNativePing(); err != nil {
+						err = closeError(err)
+						r.logger.Println(err)
+						r.close(err)
+						return
+					}
+					r.sent()
+					continue
+				}
+				if err := sendPing(r.ws); err != nil {
+					err = closeError(err)
+					r.logger.Println(err)
+					r.close(err)
+					return
+				}
+				r.sent()
+				timer = newTimer(pongTimeout)
+				timeout = timer.C
+			case <-timeout:
+				r.logger.Println(errNoPong)
+				r.close(errNoPong)
+				return
+			case <-r.pong:
+				r.ws.debug.Println("pong received")
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = nil
+				timeout = nil
+			case <-r.done:
+				return
+			case req := <-r.msg:
+				if err := r.send(req); err != nil {
+					err = closeError(err)
+					r.logger.Println(err)
+					r.close(err)
+					return
+				}
+				r.sent()
+				if re, ok := req.(*request); ok && re.Refused != "" {
+					r.close(r.refused)
+					return
+				}
+			}
+		}
+	}()
+}
+
+//sent records that a frame is sent now.
+func (r *wsRelayServer) sent() {
+	atomic.StoreInt64(&r.lastSend, time.Now().UnixNano())
+}
+
+//recentlyReceived returns true if native pings are enabled and a frame is
+//received within the half of the read deadline, so that the connection is
+//known to be alive without pongs in the data channel.
+func (r *wsRelayServer) recentlyReceived() bool {
+	if !r.nativePing {
+		return false
+	}
+	last := atomic.LoadInt64(&r.lastRecv)
+	return time.Since(time.Unix(0, last)) < r.ws.deadlines.read()/2
+}
+
+//idlePump stops the connection if no frame is received by readPump within
+//timeout.
+func (r *wsRelayServer) idlePump(timeout time.Duration) {
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-r.recv:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			case <-timer.C:
+				r.logger.Println(errIdle)
+				r.close(errIdle)
+				return
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+//maxBatch is the max # of frames in a batch.
+const maxBatch = 64
+
+//send sends req to websocket, with frames queued within the batch interval if
+//batching is enabled.
+func (r *wsRelayServer) send(req interface{}) error {
+	if r.batch <= 0 || !r.ws.has(featureBatch) {
+		return r.ws.send(req)
+	}
+	batch := []interface{}{req}
+	timer := time.NewTimer(r.batch)
+	defer timer.Stop()
+	for len(batch) < maxBatch {
+		select {
+		case m := <-r.msg:
+			batch = append(batch, m)
+			continue
+		case <-timer.C:
+		case <-r.done:
+		}
+		break
+	}
+	return r.ws.sendBatch(batch)
+}
+
+//readPump is the only reader of websocket. It reads frames from websocket and
+//dispatches pongs to writePump and responses to the requests waiting for them by ID.
+func (r *wsRelayServer) readPump() {
+	go func() {
+		for {
+			var f frame
+			if err := r.ws.receive(&f); err != nil {
+				//the ID of frames which are too large is unknown, so the
+				//connection is closed.
+				err = closeError(err)
+				logDisconnect(r.logger, err)
+				r.close(err)
+				return
+			}
+			atomic.StoreInt64(&r.lastRecv, time.Now().UnixNano())
+			select {
+			case r.recv <- struct{}{}:
+			default:
+			}
+			if f.Ready {
+				if !r.handshake(f.Version, f.Features) {
+					return
+				}
+				continue
+			}
+			if f.IsPing {
+				atomic.StoreInt64(&r.lastPong, time.Now().UnixNano())
+				select {
+				case r.pong <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			r.pmutex.Lock()
+			if b, exist := r.streams[f.ID]; exist {
+				if !f.More {
+					delete(r.streams, f.ID)
+				}
+				r.pmutex.Unlock()
+				if !f.More {
+					b.setTrailer(f.Trailer)
+				}
+				if err := b.write(f.Seq, f.Body, !f.More, f.Abort); err != nil {
+					r.logger.Println(err)
+					r.forget(f.ID)
+				}
+				continue
+			}
+			ch, exist := r.pending[f.ID]
+			delete(r.pending, f.ID)
+			res := f.ResponseWriter
+			if exist && res.More {
+				//the rest of the flushed response is buffered to the stream.
+				res.stream = newBodyStream()
+				res.stream.seq = res.Seq + 1
+				if r.streams == nil {
+					r.streams = make(map[uint64]*bodyStream)
+				}
+				r.streams[f.ID] = res.stream
+			}
+			r.pmutex.Unlock()
+			if !exist {
+				r.logger.Println("no request for response id", f.ID)
+				continue
+			}
+			ch <- &res
+		}
+	}()
+}
+
+//handshake negotiates the protocol version and features with the relay client
+//which sent version and features with Ready, and marks r as ready. It refuses the
+//relay client and returns false if its version is lower than MinProtocolVersion.
+func (r *wsRelayServer) handshake(version int, features []string) bool {
+	min := 0
+	if r.server != nil {
+		min = r.server.MinProtocolVersion
+	}
+	v, common, err := negotiate(version, features, min, r.features)
+	if err != nil {
+		r.refuse(err)
+		return false
+	}
+	atomic.StoreInt32(&r.version, int32(v))
+	r.ws.setFeatures(common)
+	r.logger.Println("relay client", r.name, "speaks protocol version", v, "with features", common)
+	r.setReady()
+	return true
+}
+
+//refuse refuses the relay client with err unless it is ready.
+func (r *wsRelayServer) refuse(err error) {
+	if !atomic.CompareAndSwapInt32(&r.ready, 0, 2) {
+		return
+	}
+	r.logger.Println("refused relay client", r.name, err)
+	r.refused = err
+	//writePump closes the connection after sending the refusal.
+	select {
+	case r.msg <- &request{Refused: err.Error()}:
+	case <-r.done:
+	}
+}
+
+//handshakePump refuses the relay client if it doesn't complete the handshake
+//within timeout, e.g. legacy ones which never send Ready.
+func (r *wsRelayServer) handshakePump(min int, timeout time.Duration) {
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			r.refuse(fmt.Errorf("%w 1, %d or higher is required", ErrIncompatibleVersion, min))
+		case <-r.done:
+		}
+	}()
+}
+
+//setReady marks r as ready, and acknowledges it before waking WaitReady of the
+//server, so that the relay client knows the features before requests.
+func (r *wsRelayServer) setReady() {
+	if !atomic.CompareAndSwapInt32(&r.ready, 0, 1) {
+		return
+	}
+	select {
+	case r.msg <- &request{Ready: true, Name: r.name, Version: ProtocolVersion, Features: r.features}:
+	case <-r.done:
+	}
+	if r.server != nil {
+		r.server.mutex.Lock()
+		if r.server.readyc != nil {
+			close(r.server.readyc)
+			r.server.readyc = nil
+		}
+		r.server.mutex.Unlock()
+	}
+}
+
+//WaitReady waits until a relay client registered as name in DefaultServer gets
+//ready.
+func WaitReady(ctx context.Context, name string) error {
+	return DefaultServer.WaitReady(ctx, name)
+}
+
+//WaitReady waits until a relay client registered as name starts serving requests,
+//and returns the error of ctx if ctx is done before it.
+func (s *Server) WaitReady(ctx context.Context, name string) error {
+	for {
+		s.mutex.Lock()
+		for _, w := range s.sockets[name] {
+			if atomic.LoadInt32(&w.ready) == 1 {
+				s.mutex.Unlock()
+				return nil
+			}
+		}
+		if s.readyc == nil {
+			s.readyc = make(chan struct{})
+		}
+		readyc := s.readyc
+		s.mutex.Unlock()
+		select {
+		case <-readyc:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//inflight returns # of requests waiting for responses.
+func (r *wsRelayServer) inflight() int {
+	r.pmutex.Lock()
+	defer r.pmutex.Unlock()
+	return len(r.pending) + len(r.streams)
+}
+
+//nextID returns a new ID of requests.
+func (s *Server) nextID() uint64 {
+	return atomic.AddUint64(&s.lastID, 1)
+}
+
+//wait registers the request with id and returns the channel which receives its
+//response. It returns ErrRelayClosed if the relay is already closed, or
+//ErrTooManyInFlight if max requests are in flight. No limit if max is zero.
+func (r *wsRelayServer) wait(id uint64, max int) (chan *ResponseWriter, error) {
+	ch := make(chan *ResponseWriter, 1)
+	r.pmutex.Lock()
+	defer r.pmutex.Unlock()
+	if r.pending == nil {
+		return nil, ErrRelayClosed
+	}
+	if max > 0 && len(r.pending)+len(r.streams) >= max {
+		return nil, ErrTooManyInFlight
+	}
+	r.pending[id] = ch
+	return ch, nil
+}
+
+//chunkSize is the max size of a chunk of streamed bodies.
+const chunkSize = 32 * 1024
+
+//errAbandoned is returned when the request is abandoned while sending its body.
+var errAbandoned = errors.New("request is abandoned")
+
+//sendBody sends body as chunks of the request with id by send.
+//It returns ErrBodyTooLarge if the body exceeds max bytes, after sending the
+//last chunk with the error. It returns errAbandoned if send fails.
+//When send fails, the abort is sent to msg directly.
+//Chunks are not compressed if compress is false.
+func (r *wsRelayServer) sendBody(id uint64, body io.ReadCloser, max int64, compress bool, send func(interface{}) bool) error {
+	defer func() {
+		if err := body.Close(); err != nil {
+			r.logger.Println(err)
+		}
+	}()
+	buf := make([]byte, chunkSize)
+	var total int64
+	for seq := 0; ; seq++ {
+		n, err := body.Read(buf)
+		total += int64(n)
+		c := &request{
+			ID:      id,
+			IsChunk: true,
+			Seq:     seq,
+			Body:    append([]byte(nil), buf[:n]...),
+
+			incompressible: !compress,
+		}
+		if max > 0 && total > max {
+			c.Body = nil
+			err = ErrBodyTooLarge
+		}
+		if err != nil {
+			c.EOF = true
+			if err != io.EOF {
+				r.logger.Println(err)
+				c.Abort = err.Error()
+			}
+		}
+		if !send(c) {
+			//tell the relay client that the body ends, so that the handler doesn't
+			//wait for it forever.
+			c.Body = nil
+			c.EOF = true
+			c.Abort = errAbandoned.Error()
+			select {
+			case r.msg <- c:
+			case <-r.done:
+			}
+			return errAbandoned
+		}
+		if err == ErrBodyTooLarge {
+			return ErrBodyTooLarge
+		}
+		if c.EOF {
+			return nil
+		}
+	}
+}
+
+//forget stops waiting the response of the request with id.
+func (r *wsRelayServer) forget(id uint64) {
+	r.pmutex.Lock()
+	defer r.pmutex.Unlock()
+	delete(r.pending, id)
+	delete(r.streams, id)
+}
+
+//canceled is sent to the request waiting for the response when it is canceled by
+//CancelRequest.
+var canceled = &ResponseWriter{}
+
+//cancelTimeout is the max time to wait for the queue to accept a cancellation by
+//CancelRequest.
+const cancelTimeout = time.Second
+
+//cancel tells the relay client to cancel the request with id, and unblocks the
+//request waiting for the response with canceled, or aborts its flushed response.
+//It returns false if the request is not in flight, or if the cancellation can't
+//be queued within cancelTimeout, leaving the request as it is.
+func (r *wsRelayServer) cancel(id uint64) bool {
+	inflight := func() bool {
+		r.pmutex.Lock()
+		defer r.pmutex.Unlock()
+		_, pending := r.pending[id]
+		_, streamed := r.streams[id]
+		return pending || streamed
+	}
+	if !inflight() {
+		return false
+	}
+	timer := time.NewTimer(cancelTimeout)
+	defer timer.Stop()
+	select {
+	case r.msg <- &request{ID: id, Cancel: true}:
+	case <-timer.C:
+		r.logger.Println("queue is full while canceling", id)
+		return false
+	case <-r.done:
+		return false
+	}
+	r.pmutex.Lock()
+	ch, pending := r.pending[id]
+	b, streamed := r.streams[id]
+	delete(r.pending, id)
+	delete(r.streams, id)
+	r.pmutex.Unlock()
+	switch {
+	case pending:
+		ch <- canceled
+	case streamed:
+		b.abort(ErrCanceled)
+	default:
+		//the response arrived while queueing the cancellation.
+		return false
+	}
+	return true
+}
+
+//abandon forgets the request with id and tells the relay client to cancel it.
+//The cancellation is dropped if the queue is full.
+func (r *wsRelayServer) abandon(id uint64) {
+	r.forget(id)
+	select {
+	case r.msg <- &request{ID: id, Cancel: true}:
+	default:
+	}
+}
+
+//cancelAll sends nil to all waiting requests and stops accepting new ones.
+func (r *wsRelayServer) cancelAll() {
+	r.pmutex.Lock()
+	defer r.pmutex.Unlock()
+	for _, ch := range r.pending {
+		ch <- nil
+	}
+	r.pending = nil
+	for _, b := range r.streams {
+		b.abort(ErrNotConnected)
+	}
+	r.streams = nil
+}
+
+//HandleServer relays request r to websocket of DefaultServer and recieve response
+//and writes it to w.
+func HandleServer(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) {
+	DefaultServer.HandleServer(name, w, r, doAccept)
+}
+
+//HandleServer relays request r to websocket and recieve response and writes it to w.
+//It stops waiting the response when the context of r is canceled, and the response
+//arriving after that is discarded.
+//The body of r is relayed as is, so it must not be consumed by parsing the form
+//before HandleServer.
+//Requests with Expect: 100-continue are answered with 100 Continue by net/http
+//when the body is read, and relayed without Expect.
+//Bodies of responses to HEAD are not written even if handlers of relay clients
+//write them, but Content-Length is their length.
+func (s *Server) HandleServer(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) {
+	_, _ = s.HandleServerE(name, w, r, doAccept)
+}
+
+//HandleServerE relays request r to websocket of DefaultServer like HandleServer,
+//and returns the status code written to w and the error of relaying.
+func HandleServerE(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) (int, error) {
+	return DefaultServer.HandleServerE(name, w, r, doAccept)
+}
+
+//HandleServerE relays request r like HandleServer, and returns the status code
+//written to w and the error of relaying.
+//The status code is 0 if nothing is written, e.g. the request is canceled or
+//the response is denied by doAccept.
+func (s *Server) HandleServerE(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) (int, error) {
+	code, _, err := s.HandleServerN(name, w, r, doAccept)
+	return code, err
+}
+
+//HandleServerN relays request r to websocket of DefaultServer like HandleServerE,
+//and also returns # of body bytes written to w.
+func HandleServerN(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) (int, int64, error) {
+	return DefaultServer.HandleServerN(name, w, r, doAccept)
+}
+
+//HandleServerN relays request r like HandleServerE, and also returns # of body
+//bytes written to w, including streamed chunks and error messages.
+func (s *Server) HandleServerN(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) (int, int64, error) {
+	rec := &statusRecorder{
+		ResponseWriter: w,
+	}
+	start := time.Now()
+	if s.AccessLog != nil {
+		e := AccessEntry{
+			Name:       name,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			Start:      start,
+		}
+		defer func() {
+			e.Status = rec.code
+			e.Bytes = rec.bytes
+			e.ID = rec.id
+			e.Duration = time.Since(start)
+			e.Err = rec.err
+			s.AccessLog(e)
+		}()
+	}
+	s.mutex.RLock()
+	if s.shutdown {
+		s.mutex.RUnlock()
+		s.logger().Println(ErrShutdown)
+		s.reject(rec, name, "shutting_down", http.StatusServiceUnavailable, "relay server is shutting down", ErrShutdown)
+		return rec.code, rec.bytes, rec.err
+	}
+	s.handling.Add(1)
+	s.mutex.RUnlock()
+	defer s.handling.Done()
+	defer func() {
+		s.metrics().ObserveRequest(name, rec.status(), time.Since(start))
+		if m, ok := s.metrics().(BytesMetrics); ok {
+			m.ObserveBytes(name, rec.bytes)
+		}
+	}()
+	if s.Tracer != nil {
+		var end func(int, error)
+		r, end = s.Tracer.Start(name, r)
+		defer func() {
+			end(rec.status(), rec.err)
+		}()
+	}
+	s.handle(name, rec, r, doAccept)
+	return rec.code, rec.bytes, rec.err
+}
+
+//Handler returns the handler which relays requests to websocket of DefaultServer
+//as the names returned by resolve.
+func Handler(resolve func(r *http.Request) string, doAccept func(*ResponseWriter) bool) http.Handler {
+	return DefaultServer.Handler(resolve, doAccept)
+}
+
+//Handler returns the handler which relays requests to the relay clients registered
+//as the names returned by resolve, e.g. from subdomains, path prefixes or headers.
+//Requests are responded with 404 if resolve returns "", or 502 if the name is not
+//registered.
+func (s *Server) Handler(resolve func(r *http.Request) string, doAccept func(*ResponseWriter) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := resolve(r)
+		if name == "" {
+			s.logger().Println("no name is resolved", r.Host, redactURL(r.URL))
+			http.NotFound(w, r)
+			return
+		}
+		s.HandleServer(name, w, r, doAccept)
+	})
+}
+
+//RelayErrorHeader is the header of error responses written by the relay server
+//or relay clients instead of backends, e.g. on timeouts or disconnections, whose
+//value is the kind of the error in Metrics. It is stripped from responses of
+//handlers of relay clients, so that backends can't forge it.
+const RelayErrorHeader = "X-Relay-Error"
+
+//reject writes the error response with code and msg to w with RelayErrorHeader,
+//and fails with err of kind.
+func (s *Server) reject(w http.ResponseWriter, name, kind string, code int, msg string, err error) {
+	w.Header().Set(RelayErrorHeader, kind)
+	http.Error(w, msg, code)
+	s.fail(w, name, kind, err)
+}
+
+//fail counts the error of kind in Metrics and records err to w returned by
+//HandleServerE.
+func (s *Server) fail(w http.ResponseWriter, name, kind string, err error) {
+	s.metrics().IncError(name, kind)
+	if rec, ok := w.(*statusRecorder); ok && rec.err == nil {
+		rec.err = err
+	}
+}
+
+//handle relays r to the relay client registered as name.
+func (s *Server) handle(name string, w http.ResponseWriter, r *http.Request, doAccept func(*ResponseWriter) bool) {
+	if !s.allow(name) {
+		s.logger().Println("too many requests", name)
+		w.Header().Set("Retry-After", s.retryAfter())
+		s.reject(w, name, "rate_limited", http.StatusTooManyRequests, "too many requests", ErrRateLimited)
+		return
+	}
+	if s.Tunnel && isTunnel(r) {
+		var timeout <-chan time.Time
+		if s.RequestTimeout > 0 {
+			timer := time.NewTimer(s.RequestTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		s.tunnel(name, w, r, timeout)
+		return
+	}
+	var policy func(http.Header)
+	if s.ResponseHeaderPolicy != nil {
+		policy = func(h http.Header) {
+			s.ResponseHeaderPolicy(name, h)
+		}
+	}
+	if s.serveCache(name, w, r, policy) {
+		return
+	}
+	if s.MaxBodyBytes > 0 && r.ContentLength > s.MaxBodyBytes {
+		s.logger().Println(ErrBodyTooLarge)
+		s.reject(w, name, "request_too_large", http.StatusRequestEntityTooLarge, "request body too large", ErrBodyTooLarge)
+		return
+	}
+	streamed := s.MaxInMemoryBody > 0 && (r.ContentLength < 0 || r.ContentLength > s.MaxInMemoryBody)
+	var re *request
+	var err error
+	if streamed {
+		re = streamRequest(r)
+	} else {
+		re, err = fromRequest(r, s.MaxBodyBytes)
+	}
+	if s.ForwardHeaders {
+		setForwarded(re, r)
+	}
+	if err != nil {
+		s.rejectBody(w, name, err)
+		return
+	}
+	re.Timeout = s.remaining(r)
+	var timeout <-chan time.Time
+	if s.RequestTimeout > 0 {
+		timer := time.NewTimer(s.RequestTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	instance := s.instance(r)
+	var tried []*wsRelayServer
+	var wsr *wsRelayServer
+	var res *ResponseWriter
+	for res == nil {
+		wsr = s.pick(name, instance, tried)
+		if wsr == nil && tried != nil && s.ReconnectWindow > 0 {
+			var ok bool
+			if wsr, ok = s.waitReconnect(name, w, r, instance, tried, timeout); !ok {
+				return
+			}
+		}
+		if wsr == nil {
+			if tried == nil {
+				s.logger().Println("not found", name)
+				s.reject(w, name, "not_connected", http.StatusBadGateway, "relay client is not connected", ErrNoRelay)
+				return
+			}
+			s.logger().Println("all relay clients are closed", name)
+			s.reject(w, name, "disconnected", http.StatusBadGateway, "relay client is disconnected", ErrRelayClosed)
+			return
+		}
+		if streamed && !wsr.ws.has(featureStream) {
+			//the body is sent in memory to relay clients without streams.
+			if err := re.readBody(r.Body, s.MaxBodyBytes); err != nil {
+				s.rejectBody(w, name, err)
+				return
+			}
+			streamed = false
+		}
+		var retry bool
+		if res, retry = s.relay(name, w, r, wsr, re, streamed, timeout); res == nil && !retry {
+			return
+		}
+		tried = append(tried, wsr)
+	}
+	//the request is encoded if it is responded. Retried ones may still be encoded
+	//by closing relays.
+	if len(tried) == 1 {
+		re.release()
+	}
+	s.debug().Println("recv response from websocket")
+	if res.stream != nil {
+		defer wsr.forget(res.ID)
+		defer func() {
+			if err := res.stream.Close(); err != nil {
+				s.logger().Println(err)
+			}
+		}()
+	}
+	if s.MaxBodyBytes > 0 && int64(len(res.Body)) > s.MaxBodyBytes {
+		s.logger().Println("response body too large", name)
+		s.reject(w, name, "response_too_large", http.StatusBadGateway, "response body too large", ErrResponseTooLarge)
+		return
+	}
+	if doAccept != nil && !doAccept(res) {
+		s.logger().Println("reponse is denied")
+		s.fail(w, name, "denied", ErrDenied)
+		return
+	}
+	s.storeCache(name, r, res)
+	head := r.Method == "HEAD"
+	if err := res.copyTo(w, policy, head); err != nil {
+		s.logger().Println(err)
+		return
+	}
+	if res.stream != nil && head {
+		//the rest of the body is never written.
+		wsr.abandon(res.ID)
+		return
+	}
+	if res.stream != nil && bodyAllowed(res.StatusCode) {
+		s.copyStream(w, r, res)
+		if r.Context().Err() != nil {
+			wsr.abandon(res.ID)
+		}
+	}
+}
+
+//rejectBody rejects the request whose body fails to be read with err.
+func (s *Server) rejectBody(w http.ResponseWriter, name string, err error) {
+	s.logger().Println(err)
+	if err == ErrBodyTooLarge {
+		s.reject(w, name, "request_too_large", http.StatusRequestEntityTooLarge, "request body too large", ErrBodyTooLarge)
+		return
+	}
+	s.reject(w, name, "bad_request", http.StatusBadRequest, "failed to read request body", err)
+}
+
+//remaining returns the time left until the deadline of r or RequestTimeout,
+//whichever is earlier, or zero if neither is set.
+func (s *Server) remaining(r *http.Request) time.Duration {
+	d := s.RequestTimeout
+	if deadline, ok := r.Context().Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			//zero means no deadline.
+			left = time.Nanosecond
+		}
+		if d <= 0 || left < d {
+			d = left
+		}
+	}
+	return d
+}
+
+//setForwarded sets X-Forwarded-* headers of re from the original request r.
+func setForwarded(re *request, r *http.Request) {
+	re.Header = re.Header.Clone()
+	if re.Header == nil {
+		re.Header = make(http.Header)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := re.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		re.Header.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	re.Header.Set("X-Forwarded-Proto", proto)
+	re.Header.Set("X-Forwarded-Host", r.Host)
+}
+
+//relay sends re to wsr and waits for its response.
+//If it fails, it returns true without writing to w when re can be retried with
+//another relay client because wsr is closed, or false after writing the error to w.
+func (s *Server) relay(name string, w http.ResponseWriter, r *http.Request, wsr *wsRelayServer, re *request, streamed bool, timeout <-chan time.Time) (*ResponseWriter, bool) {
+	id := s.nextID()
+	ch, err := wsr.wait(id, s.MaxConcurrentRequests)
+	if rec, ok := w.(*statusRecorder); ok && err == nil {
+		rec.id = strconv.FormatUint(id, 10)
+	}
+	switch err {
+	case nil:
+	case ErrTooManyInFlight:
+		s.logger().Println("too many in-flight requests", name)
+		s.reject(w, name, "too_many_in_flight", http.StatusServiceUnavailable, "relay client is busy", err)
+		return nil, false
+	default:
+		s.logger().Println("relay is closed", name)
+		return nil, true
+	}
+	closed := false
+	send := func(v interface{}) bool {
+		select {
+		case wsr.msg <- v:
+			return true
+		case <-timeout:
+			wsr.abandon(id)
+			s.logger().Println("timeout while sending request", name)
+			s.reject(w, name, "timeout", http.StatusGatewayTimeout, "relay client timed out", ErrTimeout)
+			return false
+		case <-r.Context().Done():
+			wsr.abandon(id)
+			s.logger().Println("request is canceled", name)
+			s.fail(w, name, "canceled", r.Context().Err())
+			return false
+		case <-wsr.done:
+			wsr.forget(id)
+			s.logger().Println("relay is closed while sending request", name)
+			closed = true
+			return false
+		}
+	}
+	//each attempt sends its own copy, because the relay of the previous attempt may
+	//still be encoding it.
+	attempt := *re
+	attempt.ID = id
+	re = &attempt
+	select {
+	case <-wsr.done:
+		wsr.forget(id)
+		s.logger().Println("relay is closed before sending request", name)
+		return nil, true
+	default:
+	}
+	//requests are refused instead of waiting when the queue is full, while
+	//chunks of bodies wait for it.
+	select {
+	case wsr.msg <- re:
+	default:
+		wsr.forget(id)
+		s.logger().Println("queue is full", name)
+		s.reject(w, name, "queue_full", http.StatusServiceUnavailable, "relay client is busy", ErrQueueFull)
+		return nil, false
+	}
+	s.metrics().SetQueueDepth(name, len(wsr.msg))
+	s.debug().Println("sent request to websocket", re.redacted(s.RedactHeaders))
+	if streamed {
+		switch err := wsr.sendBody(id, r.Body, s.MaxBodyBytes, compressible(r.Header), send); err {
+		case nil:
+		case ErrBodyTooLarge:
+			wsr.abandon(id)
+			s.logger().Println(err)
+			s.reject(w, name, "request_too_large", http.StatusRequestEntityTooLarge, "request body too large", ErrBodyTooLarge)
+			return nil, false
+		default:
+			//the body is partly consumed, so it cannot be retried.
+			if closed {
+				s.reject(w, name, "disconnected", http.StatusBadGateway, "relay client is disconnected", ErrRelayClosed)
+			}
+			return nil, false
+		}
+		s.debug().Println("sent request body to websocket")
+	}
+
+	var res *ResponseWriter
+	select {
+	case res = <-ch:
+	case <-timeout:
+		wsr.abandon(id)
+		s.logger().Println("timeout while waiting response", name)
+		s.reject(w, name, "timeout", http.StatusGatewayTimeout, "relay client timed out", ErrTimeout)
+		return nil, false
+	case <-r.Context().Done():
+		wsr.abandon(id)
+		s.logger().Println("request is canceled while waiting response", name)
+		s.fail(w, name, "canceled", r.Context().Err())
+		return nil, false
+	}
+	if res == canceled {
+		s.reject(w, name, "canceled", http.StatusServiceUnavailable, "request is canceled", ErrCanceled)
+		return nil, false
+	}
+	if res == nil {
+		s.logger().Println("relay is closed while waiting response", name)
+		//requests which may have been processed are retried only if idempotent.
+		if !streamed && retryable(r) {
+			return nil, true
+		}
+		s.reject(w, name, "disconnected", http.StatusBadGateway, "relay client is disconnected", ErrRelayClosed)
+		return nil, false
+	}
+	return res, false
+}
+
+//waitReconnect waits for ReconnectWindow until a relay client registered as name
+//which is not tried reconnects, and returns it. It returns nil if no one
+//reconnects in the window. It returns false if r is canceled or timed out while
+//waiting, and responded.
+func (s *Server) waitReconnect(name string, w http.ResponseWriter, r *http.Request, instance string, tried []*wsRelayServer, timeout <-chan time.Time) (*wsRelayServer, bool) {
+	s.logger().Println("waiting for the relay client to reconnect", name)
+	ctx, cancel := context.WithTimeout(r.Context(), s.ReconnectWindow)
+	defer cancel()
+	for {
+		readyc := make(chan error, 1)
+		go func() {
+			readyc <- s.WaitReady(ctx, name)
+		}()
+		select {
+		case err := <-readyc:
+			if err != nil {
+				if r.Context().Err() != nil {
+					s.logger().Println("request is canceled while waiting reconnection", name)
+					s.fail(w, name, "canceled", r.Context().Err())
+					return nil, false
+				}
+				return nil, true
+			}
+			if wsr := s.pick(name, instance, tried); wsr != nil {
+				return wsr, true
+			}
+			//the tried one is still registered while closing.
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+			}
+		case <-timeout:
+			cancel()
+			<-readyc
+			s.logger().Println("timeout while waiting reconnection", name)
+			s.reject(w, name, "timeout", http.StatusGatewayTimeout, "relay client timed out", ErrTimeout)
+			return nil, false
+		}
+	}
+}
+
+//instance returns the instance ID of the relay client selected by Instance for r.
+func (s *Server) instance(r *http.Request) string {
+	if s.Instance == nil {
+		return ""
+	}
+	return s.Instance(r)
+}
+
+//retryable returns true if r can be retried after it may have been processed,
+//i.e. its method is idempotent or it has an idempotency key.
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	_, xok := r.Header["X-Idempotency-Key"]
+	return ok || xok
+}
+
+//copyStream writes the rest of the flushed response res to w, and flushes w
+//every time a chunk is written.
+//The response is aborted with http.ErrAbortHandler if res is aborted or exceeds
+//MaxBodyBytes.
+func (s *Server) copyStream(w http.ResponseWriter, r *http.Request, res *ResponseWriter) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			if err := res.stream.Close(); err != nil {
+				s.logger().Println(err)
+			}
+		case <-stop:
+		}
+	}()
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+	written := int64(len(res.Body))
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := res.stream.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			if s.MaxBodyBytes > 0 && written > s.MaxBodyBytes {
+				s.logger().Println("response body too large")
+				panic(http.ErrAbortHandler)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				s.logger().Println(err)
+				return
+			}
+			flush()
+		}
+		switch {
+		case err == io.EOF:
+			writeTrailer(w, res.stream.getTrailer())
+			return
+		case err != nil && r.Context().Err() != nil:
+			s.logger().Println("request is canceled while streaming response")
+			return
+		case err != nil:
+			s.logger().Println(err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
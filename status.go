@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//Status is the status of Server reported by StatusHandler.
+type Status struct {
+	//ShuttingDown is true after Shutdown is called.
+	ShuttingDown bool `json:"shutting_down"`
+	//Connected is # of relay clients.
+	Connected int32 `json:"connected"`
+	//Names are the sorted names of relay clients.
+	Names []string `json:"names"`
+	//LastPong is the time when the last pong is received from relay clients by name.
+	//Names which have not replied any pong are not included.
+	LastPong map[string]time.Time `json:"last_pong"`
+	//InFlight is # of in-flight requests by name.
+	InFlight map[string]int `json:"in_flight"`
+	//RemoteAddrs are the network addresses of relay clients by name.
+	RemoteAddrs map[string][]string `json:"remote_addrs"`
+	//ProtocolVersions are the protocol versions negotiated with relay clients by
+	//name, which are 0 until the handshakes are done.
+	ProtocolVersions map[string][]int `json:"protocol_versions"`
+	//Connections are the activities of connections to relay clients by name.
+	Connections map[string][]ConnStatus `json:"connections"`
+}
+
+//ConnStatus is the activity of a connection to a relay client, for diagnosing
+//stale or flapping relay clients.
+type ConnStatus struct {
+	//RemoteAddr is the network address of the relay client.
+	RemoteAddr string `json:"remote_addr"`
+	//InstanceID is the instance ID advertised by the relay client.
+	InstanceID string `json:"instance_id,omitempty"`
+	//ConnectedAt is when the connection is established.
+	ConnectedAt time.Time `json:"connected_at"`
+	//LastReadAt and LastWriteAt are when the last frame is received from and
+	//sent to the relay client, which are zero if none is.
+	LastReadAt  time.Time `json:"last_read_at"`
+	LastWriteAt time.Time `json:"last_write_at"`
+}
+
+//connStatus returns the activity of w.
+func (w *wsRelayServer) connStatus() ConnStatus {
+	st := ConnStatus{
+		RemoteAddr:  w.remoteAddr,
+		InstanceID:  w.instance,
+		ConnectedAt: w.connectedAt,
+	}
+	if t := atomic.LoadInt64(&w.lastRecv); t > 0 {
+		st.LastReadAt = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&w.lastSend); t > 0 {
+		st.LastWriteAt = time.Unix(0, t)
+	}
+	return st
+}
+
+//Connections returns the activities of connections to the relay clients registered
+//as name in DefaultServer.
+func Connections(name string) []ConnStatus {
+	return DefaultServer.Connections(name)
+}
+
+//Connections returns the activities of connections to the relay clients registered
+//as name, in the order they are connected.
+func (s *Server) Connections(name string) []ConnStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var sts []ConnStatus
+	for _, w := range s.sockets[name] {
+		sts = append(sts, w.connStatus())
+	}
+	return sts
+}
+
+//Status returns the status of s.
+func (s *Server) Status() Status {
+	st := Status{
+		Connected:        s.Count(),
+		LastPong:         make(map[string]time.Time),
+		InFlight:         make(map[string]int),
+		RemoteAddrs:      make(map[string][]string),
+		ProtocolVersions: make(map[string][]int),
+		Connections:      make(map[string][]ConnStatus),
+	}
+	s.mutex.RLock()
+	st.ShuttingDown = s.shutdown
+	st.Names = make([]string, 0, len(s.sockets))
+	for n, ws := range s.sockets {
+		st.Names = append(st.Names, n)
+		var last int64
+		for _, w := range ws {
+			st.RemoteAddrs[n] = append(st.RemoteAddrs[n], w.remoteAddr)
+			st.ProtocolVersions[n] = append(st.ProtocolVersions[n], int(atomic.LoadInt32(&w.version)))
+			st.InFlight[n] += w.inflight()
+			st.Connections[n] = append(st.Connections[n], w.connStatus())
+			if p := atomic.LoadInt64(&w.lastPong); p > last {
+				last = p
+			}
+		}
+		if last > 0 {
+			st.LastPong[n] = time.Unix(0, last)
+		}
+	}
+	s.mutex.RUnlock()
+	sort.Strings(st.Names)
+	return st
+}
+
+//StatusHandler returns the handler which responds the status of s with JSON.
+//It responds with 503 while shutting down so that it can be used for health checks.
+func (s *Server) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := s.Status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if st.ShuttingDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			s.logger().Println(err)
+		}
+	})
+}
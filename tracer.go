@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import "net/http"
+
+//Tracer traces requests relayed by a relay server. Methods must be safe for
+//concurrent use.
+//
+//Headers of relayed requests are copied to relay clients, so trace contexts are
+//propagated by injecting them to the headers, and extracted by the handlers of
+//relay clients. It can be adapted to OpenTelemetry like:
+//
+//	type otelTracer struct {
+//		tracer trace.Tracer
+//	}
+//
+//	func (t otelTracer) Start(name string, r *http.Request) (*http.Request, func(int, error)) {
+//		prop := propagation.TraceContext{}
+//		ctx := prop.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+//		ctx, span := t.tracer.Start(ctx, "relay "+name, trace.WithSpanKind(trace.SpanKindClient))
+//		r = r.WithContext(ctx)
+//		prop.Inject(ctx, propagation.HeaderCarrier(r.Header))
+//		return r, func(status int, err error) {
+//			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+//			if err != nil {
+//				span.RecordError(err)
+//				span.SetStatus(codes.Error, err.Error())
+//			}
+//			span.End()
+//		}
+//	}
+//
+//and relay clients serve with otelhttp.NewHandler to continue the trace.
+type Tracer interface {
+	//Start starts the span of relaying r to the relay client registered as name.
+	//It returns the request to be relayed instead of r, e.g. with the trace context
+	//in its context and header, and the function which ends the span with the
+	//status code and the error returned by HandleServerE.
+	Start(name string, r *http.Request) (*http.Request, func(status int, err error))
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2015, Shinya Yagyu
+ * All rights reserved.
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from this
+ *    software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotTunnel = errors.New("not a tunnel")
+var errHijacked = errors.New("already hijacked")
+var errNotHijacker = errors.New("http.ResponseWriter is not http.Hijacker")
+
+//isTunnel returns true if r is CONNECT or an upgrade request.
+func isTunnel(r *http.Request) bool {
+	if r.Method == "CONNECT" {
+		return true
+	}
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, vs := range r.Header["Connection"] {
+		for _, v := range strings.Split(vs, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Hijack returns the connection tunneled through the relay server in relay clients
+//if the request is CONNECT or an upgrade and Server.Tunnel is enabled.
+//Bytes written to it are sent to the original client as they are, including the
+//response line and headers.
+func (r *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.tunnel == nil {
+		return nil, nil, errNotTunnel
+	}
+	if r.hijacked {
+		return nil, nil, errHijacked
+	}
+	r.hijacked = true
+	t := &tunnelConn{
+		w: r,
+	}
+	return t, bufio.NewReadWriter(bufio.NewReader(t), bufio.NewWriter(t)), nil
+}
+
+//tunnelConn is a connection hijacked from ResponseWriter. It reads the chunks
+//from the original client and writes frames to it.
+type tunnelConn struct {
+	w     *ResponseWriter
+	mutex sync.Mutex
+	once  sync.Once
+}
+
+func (t *tunnelConn) Read(p []byte) (int, error) {
+	return t.w.tunnel.Read(p)
+}
+
+func (t *tunnelConn) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.w.err != nil {
+		return 0, t.w.err
+	}
+	t.w.Body = append(t.w.Body, p...)
+	t.w.More = true
+	t.w.Hijacked = true
+	if t.w.err = t.w.sendFrame(); t.w.err != nil {
+		return 0, t.w.err
+	}
+	return len(p), nil
+}
+
+//Close sends the last frame, which closes the connection of the original client.
+func (t *tunnelConn) Close() error {
+	var err error
+	t.once.Do(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if errc := t.w.tunnel.Close(); errc != nil {
+			t.w.ws.logger.Println(errc)
+		}
+		if t.w.err != nil {
+			err = t.w.err
+			return
+		}
+		t.w.More = false
+		t.w.Hijacked = true
+		err = t.w.sendFrame()
+	})
+	return err
+}
+
+func (t *tunnelConn) LocalAddr() net.Addr {
+	return t.w.ws.LocalAddr()
+}
+
+func (t *tunnelConn) RemoteAddr() net.Addr {
+	return t.w.ws.RemoteAddr()
+}
+
+//SetDeadline does nothing. Deadlines of the relay connection are used instead.
+func (t *tunnelConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+//SetReadDeadline does nothing.
+func (t *tunnelConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+//SetWriteDeadline does nothing.
+func (t *tunnelConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+//tunnel relays CONNECT or the upgrade request r to a relay client registered as
+//name, and pumps bytes between the hijacked connection of r and the relay client
+//until either side closes.
+func (s *Server) tunnel(name string, w http.ResponseWriter, r *http.Request, timeout <-chan time.Time) {
+	wsr := s.pick(name, s.instance(r), nil)
+	if wsr == nil {
+		s.logger().Println("not found", name)
+		s.reject(w, name, "not_connected", http.StatusBadGateway, "relay client is not connected", ErrNoRelay)
+		return
+	}
+	if !wsr.ws.has(featureTunnel) {
+		s.logger().Println("tunnel is not supported by", name)
+		s.reject(w, name, "not_supported", http.StatusNotImplemented, "tunnel is not supported by the relay client", ErrNotSupported)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if rec, isRec := w.(*statusRecorder); isRec {
+		//statusRecorder is always http.Hijacker.
+		_, ok = rec.ResponseWriter.(http.Hijacker)
+	}
+	if !ok {
+		s.logger().Println("tunnel is not supported by http.ResponseWriter")
+		s.reject(w, name, "not_supported", http.StatusInternalServerError, "tunnel is not supported", errNotHijacker)
+		return
+	}
+	id := s.nextID()
+	ch, err := wsr.wait(id, s.MaxConcurrentRequests)
+	if rec, ok := w.(*statusRecorder); ok && err == nil {
+		rec.id = strconv.FormatUint(id, 10)
+	}
+	switch err {
+	case nil:
+	case ErrTooManyInFlight:
+		s.logger().Println("too many in-flight requests", name)
+		s.reject(w, name, "too_many_in_flight", http.StatusServiceUnavailable, "relay client is busy", err)
+		return
+	default:
+		s.logger().Println("relay is closed", name)
+		s.reject(w, name, "not_connected", http.StatusBadGateway, "relay client is not connected", ErrNoRelay)
+		return
+	}
+	defer wsr.forget(id)
+	re := newRequest(r, nil)
+	re.ID = id
+	re.Streamed = true
+	re.Tunnel = true
+	select {
+	case wsr.msg <- re:
+	case <-wsr.done:
+		s.logger().Println("relay is closed while sending request", name)
+		s.reject(w, name, "disconnected", http.StatusBadGateway, "relay client is disconnected", ErrRelayClosed)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		s.logger().Println(err)
+		s.reject(w, name, "not_supported", http.StatusInternalServerError, "tunnel is not supported", err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.logger().Println(err)
+		}
+	}()
+	go func() {
+		send := func(v interface{}) bool {
+			select {
+			case wsr.msg <- v:
+				return true
+			case <-wsr.done:
+				return false
+			}
+		}
+		if err := wsr.sendBody(id, ioutil.NopCloser(rw.Reader), 0, r.Method != "CONNECT", send); err != nil {
+			s.logger().Println(err)
+		}
+	}()
+
+	var res *ResponseWriter
+	select {
+	case res = <-ch:
+	case <-timeout:
+		s.logger().Println("timeout while waiting response", name)
+		s.fail(w, name, "timeout", ErrTimeout)
+		return
+	}
+	if res == nil {
+		s.logger().Println("relay is closed while waiting response", name)
+		s.fail(w, name, "disconnected", ErrRelayClosed)
+		return
+	}
+	if res == canceled {
+		s.fail(w, name, "canceled", ErrCanceled)
+		return
+	}
+	var rest io.Reader = bytes.NewReader(nil)
+	if res.stream != nil {
+		defer func() {
+			if err := res.stream.Close(); err != nil {
+				s.logger().Println(err)
+			}
+		}()
+		rest = res.stream
+	}
+	if res.Hijacked {
+		if _, err := conn.Write(res.Body); err != nil {
+			s.logger().Println(err)
+			return
+		}
+		if _, err := io.Copy(conn, rest); err != nil {
+			s.logger().Println(err)
+		}
+		return
+	}
+	//the handler responded without hijacking.
+	resp := &http.Response{
+		StatusCode:    res.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        res.Head,
+		Body:          ioutil.NopCloser(io.MultiReader(bytes.NewReader(res.Body), rest)),
+		ContentLength: int64(len(res.Body)),
+		Close:         true,
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if res.stream != nil {
+		resp.ContentLength = -1
+	}
+	if err := resp.Write(conn); err != nil {
+		s.logger().Println(err)
+	}
+}
+
+//Hijack hijacks the underlying http.ResponseWriter if it is http.Hijacker.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotTunnel
+	}
+	if r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}